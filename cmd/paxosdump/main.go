@@ -0,0 +1,70 @@
+package main
+
+//
+// print a running Paxos peer's state, through its Paxos.Inspect
+// RPC. the port is the peer's unix socket path or TCP host:port
+// (for shardkv and shardmaster, the server's own port).
+//
+// go run ./cmd/paxosdump [-from seq] [-to seq] port
+//
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"umich.edu/eecs491/proj5/common"
+	"umich.edu/eecs491/proj5/paxos"
+)
+
+func main() {
+	from := flag.Int("from", 0, "first instance to print")
+	to := flag.Int("to", -1, "last instance to print (-1: the highest known)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: paxosdump [-from seq] [-to seq] port\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	port := flag.Arg(0)
+
+	args := &paxos.InspectArgs{From: *from, To: *to}
+	var reply paxos.InspectReply
+	if !common.Call(port, "Paxos.Inspect", args, &reply) {
+		fmt.Fprintf(os.Stderr, "paxosdump: cannot reach %v\n", port)
+		os.Exit(1)
+	}
+
+	fmt.Printf("peer %v (%v)\n", reply.Me, port)
+	fmt.Printf("members   %v\n", reply.Members)
+	if len(reply.Learners) > 0 {
+		fmt.Printf("learners  %v\n", reply.Learners)
+	}
+	fmt.Printf("localDone %v\n", reply.LocalDone)
+	fmt.Printf("peersDone\n")
+	for idx, peer := range reply.Peers {
+		fmt.Printf("  %v %v\n", peer, reply.PeersDone[idx])
+	}
+	fmt.Printf("min %v max %v leader %v proposers %v\n",
+		reply.Min, reply.Max, reply.LeaderId, reply.Proposers)
+	if reply.Leased != "" {
+		fmt.Printf("lease held by %v\n", reply.Leased)
+	}
+	fmt.Printf("instances\n")
+	for _, inst := range reply.Instances {
+		fmt.Printf("  %v:", inst.Seq)
+		if inst.HasNp {
+			fmt.Printf(" np=%v.%v", inst.Np.Number, inst.Np.Id)
+		}
+		if inst.HasNa {
+			fmt.Printf(" na=%v.%v va=%v", inst.Na.Number, inst.Na.Id, inst.Va)
+		}
+		if inst.Decided {
+			fmt.Printf(" decided=%v", inst.V)
+		}
+		fmt.Printf("\n")
+	}
+}
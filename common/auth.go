@@ -0,0 +1,246 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+//
+// optional message authentication.
+//
+// a key set with SetKey(addr, key) protects the server at addr:
+// every request this process sends there carries an HMAC-SHA256
+// over addr, the method, a timestamp, a random nonce and the
+// encoded arguments, and the server, serving its connections through
+// ServeConn() or ServeUnreliable() under addr, rejects a request
+// whose MAC does not check out, that is more than ReplayWindow
+// old, or whose nonce it has already seen. the servers of a
+// replica group usually share one key; the MAC covering addr
+// keeps a request sent to one of them from being replayed to
+// another. replies are not authenticated.
+//
+
+const ReplayWindow = 30 * time.Second
+
+var errUnauthenticated = errors.New("rpc: unauthenticated request")
+
+var (
+	keysMu sync.Mutex
+	keys   = make(map[string][]byte)
+	seen   = make(map[string]*replayCache) // per server address
+)
+
+//
+// protect RPCs to the server at addr with key; a nil key
+// turns authentication off again.
+//
+func SetKey(addr string, key []byte) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	if key == nil {
+		delete(keys, addr)
+		return
+	}
+	keys[addr] = append([]byte(nil), key...)
+	if _, ok := seen[addr]; !ok {
+		seen[addr] = &replayCache{nonces: make(map[int64]int64)}
+	}
+}
+
+func keyFor(addr string) ([]byte, *replayCache) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	return keys[addr], seen[addr]
+}
+
+//
+// what an authenticated request carries in place of its args.
+//
+type sealedArgs struct {
+	Time  int64 // UnixNano
+	Nonce int64
+	Body  []byte // the gob-encoded args
+	MAC   []byte
+}
+
+func mac(key []byte, srv string, method string, s *sealedArgs) []byte {
+	h := hmac.New(sha256.New, key)
+	// length-prefixed, so that srv and method cannot trade bytes.
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(srv)))
+	h.Write(n[:])
+	h.Write([]byte(srv))
+	h.Write([]byte(method))
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(s.Time))
+	binary.BigEndian.PutUint64(buf[8:], uint64(s.Nonce))
+	h.Write(buf[:])
+	h.Write(s.Body)
+	return h.Sum(nil)
+}
+
+func seal(key []byte, srv string, method string, args interface{}) (*sealedArgs, error) {
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(args); err != nil {
+		return nil, err
+	}
+	s := &sealedArgs{Time: time.Now().UnixNano(), Nonce: Nrand(), Body: body.Bytes()}
+	s.MAC = mac(key, srv, method, s)
+	return s, nil
+}
+
+//
+// nonces seen within the last ReplayWindow, with their times.
+//
+type replayCache struct {
+	mu     sync.Mutex
+	nonces map[int64]int64
+	purged int64
+}
+
+//
+// has s been seen before (or is it too old to tell)?
+//
+func (rc *replayCache) replayed(s *sealedArgs) bool {
+	now := time.Now().UnixNano()
+	window := int64(ReplayWindow)
+	if s.Time < now-window || s.Time > now+window {
+		return true
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if now-rc.purged > window {
+		for nonce, t := range rc.nonces {
+			if t < now-window {
+				delete(rc.nonces, nonce)
+			}
+		}
+		rc.purged = now
+	}
+	if _, ok := rc.nonces[s.Nonce]; ok {
+		return true
+	}
+	rc.nonces[s.Nonce] = s.Time
+	return false
+}
+
+//
+// a client for the server at srv over conn, sealing every
+// request if srv has a key.
+//
+func NewClient(conn net.Conn, srv string) *rpc.Client {
+	key, _ := keyFor(srv)
+	if key == nil {
+		return rpc.NewClient(conn)
+	}
+	buf := bufio.NewWriter(conn)
+	return rpc.NewClientWithCodec(&authClientCodec{
+		gobClientCodec: gobClientCodec{conn, gob.NewDecoder(conn), gob.NewEncoder(buf), buf},
+		key:            key,
+		srv:            srv,
+	})
+}
+
+type authClientCodec struct {
+	gobClientCodec
+	key []byte
+	srv string
+}
+
+func (c *authClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	s, err := seal(c.key, c.srv, r.ServiceMethod, body)
+	if err != nil {
+		return err
+	}
+	return c.gobClientCodec.WriteRequest(r, s)
+}
+
+//
+// serve conn like rpc.ServeConn, checking requests against
+// addr's key, if it has one. addr is the server's own address.
+//
+func ServeConn(rpcs *rpc.Server, conn net.Conn, addr string) {
+	buf := bufio.NewWriter(conn)
+	codec := &gobServerCodec{conn, gob.NewDecoder(conn), gob.NewEncoder(buf), buf}
+	rpcs.ServeCodec(authenticate(codec, addr))
+}
+
+//
+// wrap codec so that it checks requests against addr's key.
+//
+func authenticate(codec rpc.ServerCodec, addr string) rpc.ServerCodec {
+	key, cache := keyFor(addr)
+	if key == nil {
+		return codec
+	}
+	return &authServerCodec{ServerCodec: codec, key: key, cache: cache, addr: addr}
+}
+
+type authServerCodec struct {
+	rpc.ServerCodec
+	key    []byte
+	cache  *replayCache
+	addr   string
+	method string // of the request being read
+}
+
+func (c *authServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := c.ServerCodec.ReadRequestHeader(r)
+	c.method = r.ServiceMethod
+	return err
+}
+
+func (c *authServerCodec) ReadRequestBody(body interface{}) error {
+	var s sealedArgs
+	if err := c.ServerCodec.ReadRequestBody(&s); err != nil {
+		return err
+	}
+	if body == nil {
+		// the request is being discarded anyway.
+		return nil
+	}
+	if !hmac.Equal(s.MAC, mac(c.key, c.addr, c.method, &s)) || c.cache.replayed(&s) {
+		return errUnauthenticated
+	}
+	return gob.NewDecoder(bytes.NewReader(s.Body)).Decode(body)
+}
+
+// the client side of the codec inside net/rpc.
+type gobClientCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+}
+
+func (c *gobClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobClientCodec) ReadResponseBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobClientCodec) Close() error {
+	return c.rwc.Close()
+}
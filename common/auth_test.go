@@ -0,0 +1,117 @@
+package common
+
+import (
+	"bufio"
+	"encoding/gob"
+	"net/rpc"
+	"testing"
+)
+
+//
+// start an Echo server on the simulated network that checks
+// requests against addr's key.
+//
+func serveAuthEcho(t *testing.T, sn *SimNetwork, addr string) {
+	rpcs := rpc.NewServer()
+	rpcs.Register(new(Echo))
+	l, err := sn.Listen(addr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go ServeConn(rpcs, conn, addr)
+		}
+	}()
+}
+
+//
+// a client to addr on sn whose requests all carry s.
+//
+type fixedCodec struct {
+	gobClientCodec
+	s *sealedArgs
+}
+
+func (c *fixedCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	return c.gobClientCodec.WriteRequest(r, c.s)
+}
+
+func fixedClient(sn *SimNetwork, addr string, s *sealedArgs) *rpc.Client {
+	conn := sn.listeners[addr].dial()
+	buf := bufio.NewWriter(conn)
+	return rpc.NewClientWithCodec(&fixedCodec{
+		gobClientCodec: gobClientCodec{conn, gob.NewDecoder(conn), gob.NewEncoder(buf), buf},
+		s:              s,
+	})
+}
+
+func TestAuth(t *testing.T) {
+	sn := NewSimNetwork(SeedFromEnv())
+	key := []byte("group key")
+	SetKey("secured", key)
+	defer SetKey("secured", nil)
+	serveAuthEcho(t, sn, "secured")
+
+	x := 7
+	var reply int
+	if !sn.Call("secured", "Echo.Echo", &x, &reply) || reply != x {
+		t.Fatalf("a call with the right key failed")
+	}
+
+	// no MAC at all.
+	c := rpc.NewClient(sn.listeners["secured"].dial())
+	if err := c.Call("Echo.Echo", &x, &reply); err == nil {
+		t.Fatalf("an unauthenticated call went through")
+	}
+	c.Close()
+
+	// the wrong key.
+	forged, _ := seal([]byte("other key"), "secured", "Echo.Echo", &x)
+	c = fixedClient(sn, "secured", forged)
+	if err := c.Call("Echo.Echo", &x, &reply); err == nil {
+		t.Fatalf("a call with the wrong key went through")
+	}
+	c.Close()
+
+	// a replay, even over a new connection.
+	sealed, _ := seal(key, "secured", "Echo.Echo", &x)
+	c = fixedClient(sn, "secured", sealed)
+	if err := c.Call("Echo.Echo", &x, &reply); err != nil {
+		t.Fatalf("a sealed call failed: %v", err)
+	}
+	c.Close()
+	c = fixedClient(sn, "secured", sealed)
+	if err := c.Call("Echo.Echo", &x, &reply); err == nil {
+		t.Fatalf("a replayed call went through")
+	}
+	c.Close()
+
+	// sealed for another method.
+	other, _ := seal(key, "secured", "Echo.Other", &x)
+	c = fixedClient(sn, "secured", other)
+	if err := c.Call("Echo.Echo", &x, &reply); err == nil {
+		t.Fatalf("a call went through under another method")
+	}
+	c.Close()
+
+	// sealed for another server of the group, under the same key.
+	SetKey("other", key)
+	defer SetKey("other", nil)
+	serveAuthEcho(t, sn, "other")
+	elsewhere, _ := seal(key, "other", "Echo.Echo", &x)
+	c = fixedClient(sn, "other", elsewhere)
+	if err := c.Call("Echo.Echo", &x, &reply); err != nil {
+		t.Fatalf("a call sealed for other failed: %v", err)
+	}
+	c.Close()
+	c = fixedClient(sn, "secured", elsewhere)
+	if err := c.Call("Echo.Echo", &x, &reply); err == nil {
+		t.Fatalf("a call sealed for other went through at secured")
+	}
+	c.Close()
+}
@@ -0,0 +1,170 @@
+package common
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+//
+// PartitionController is a Transport for integration tests
+// that passes calls on to another Transport unless a Rule says
+// otherwise. install it with SetTransport(); servers then call
+// through CallAs() with their own address, so that rules can
+// tell who is calling whom. clients are Anonymous.
+//
+// a call from an endpoint to itself is never interfered with.
+//
+
+// matches every endpoint in a Rule, Anonymous included.
+const AnyEndpoint = "*"
+
+//
+// what to do with calls from an endpoint in From to one in To
+// (and, with Both, from To to From). Block fails the call
+// without sending it; otherwise the call is held back for
+// Delay and its request or reply is lost with the given
+// probabilities.
+//
+type Rule struct {
+	From        []string
+	To          []string
+	Both        bool
+	Block       bool
+	Delay       time.Duration
+	DropRequest float64
+	DropReply   float64
+}
+
+type PartitionController struct {
+	inner  Transport
+	mu     sync.Mutex
+	rules  map[int]Rule
+	nextId int
+	rng    *rand.Rand
+}
+
+//
+// a controller in front of inner, with no rules yet.
+//
+func NewPartitionController(inner Transport) *PartitionController {
+	pc := &PartitionController{inner: inner}
+	pc.rules = make(map[int]Rule)
+	pc.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	return pc
+}
+
+//
+// start applying r. returns an id for Remove().
+//
+func (pc *PartitionController) Add(r Rule) int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.nextId++
+	pc.rules[pc.nextId] = r
+	return pc.nextId
+}
+
+func (pc *PartitionController) Remove(id int) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	delete(pc.rules, id)
+}
+
+//
+// cut every endpoint in a off from every endpoint in b, both
+// ways, until Remove() of the returned id.
+//
+func (pc *PartitionController) Isolate(a []string, b []string) int {
+	return pc.Add(Rule{From: a, To: b, Both: true, Block: true})
+}
+
+//
+// remove every rule.
+//
+func (pc *PartitionController) HealAll() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.rules = make(map[int]Rule)
+}
+
+func contains(set []string, endpoint string) bool {
+	for _, e := range set {
+		if e == endpoint || e == AnyEndpoint {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Rule) matches(from, to string) bool {
+	if contains(r.From, from) && contains(r.To, to) {
+		return true
+	}
+	return r.Both && contains(r.To, from) && contains(r.From, to)
+}
+
+//
+// combine the rules for one call: blocked, the total delay,
+// and whether the request and the reply get through.
+//
+func (pc *PartitionController) judge(from, to string) (bool, time.Duration, bool, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	blocked := false
+	var delay time.Duration
+	requestOK, replyOK := true, true
+	if from == to {
+		return blocked, delay, requestOK, replyOK
+	}
+	for _, r := range pc.rules {
+		if !r.matches(from, to) {
+			continue
+		}
+		blocked = blocked || r.Block
+		delay += r.Delay
+		if pc.rng.Float64() < r.DropRequest {
+			requestOK = false
+		}
+		if pc.rng.Float64() < r.DropReply {
+			replyOK = false
+		}
+	}
+	return blocked, delay, requestOK, replyOK
+}
+
+func (pc *PartitionController) call(from, srv string, rpcname string, args interface{}, reply interface{}) bool {
+	blocked, delay, requestOK, replyOK := pc.judge(from, srv)
+	if blocked || !requestOK {
+		return false
+	}
+	time.Sleep(delay)
+	ok := pc.inner.Call(srv, rpcname, args, reply)
+	return ok && replyOK
+}
+
+func (pc *PartitionController) Call(srv string, rpcname string, args interface{}, reply interface{}) bool {
+	return pc.call(Anonymous, srv, rpcname, args, reply)
+}
+
+func (pc *PartitionController) Listen(addr string) (net.Listener, error) {
+	return pc.inner.Listen(addr)
+}
+
+func (pc *PartitionController) Endpoint(name string) Transport {
+	return &controlledEndpoint{pc: pc, name: name}
+}
+
+type controlledEndpoint struct {
+	pc   *PartitionController
+	name string
+}
+
+func (e *controlledEndpoint) Call(srv string, rpcname string, args interface{}, reply interface{}) bool {
+	return e.pc.call(e.name, srv, rpcname, args, reply)
+}
+
+func (e *controlledEndpoint) Listen(addr string) (net.Listener, error) {
+	return e.pc.Listen(addr)
+}
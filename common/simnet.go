@@ -0,0 +1,360 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//
+// SimNetwork is an in-process network for tests. it is a
+// Transport, so it can replace the real one for everything
+// (SetTransport), and Endpoint(name) gives a Transport for a
+// named peer whose calls are subject to partitions and
+// per-link settings (see paxos.WithTransport).
+//
+// every RPC still goes through net/rpc and gob, over an
+// in-memory pipe, so handlers see exactly what they would see
+// on a socket.
+//
+// faults are drawn from one random stream per link (from, to),
+// seeded from the network's seed and the link's names. the same
+// seed thus gives the same fate to the n-th message on a link,
+// and a failing run can be replayed by running it again with
+// its seed (see SeedFromEnv). goroutine scheduling can still
+// change the order in which messages use a link.
+//
+
+// name of the source for calls made through the network itself.
+const Anonymous = ""
+
+//
+// how a link treats its messages. probabilities are in [0, 1].
+// each message (request or reply) is held back for a random
+// time in [MinDelay, MaxDelay]; with probability Reorder it is
+// held back for another MaxDelay on top, so that later
+// messages overtake it.
+//
+type LinkConfig struct {
+	DropRequest float64
+	DropReply   float64
+	MinDelay    time.Duration
+	MaxDelay    time.Duration
+	Reorder     float64
+}
+
+//
+// what happened to one call, for the schedule.
+//
+type SimEvent struct {
+	From, To string
+	RPC      string
+	N        int // the call's number on its link
+	Fate     string
+	Delay    time.Duration
+}
+
+const (
+	FateDelivered   = "delivered"
+	FatePartitioned = "partitioned"
+	FateNoServer    = "no server"
+	FateDropRequest = "request dropped"
+	FateDropReply   = "reply dropped"
+)
+
+type SimNetwork struct {
+	mu        sync.Mutex
+	seed      int64
+	defaults  LinkConfig
+	configs   map[[2]string]LinkConfig
+	links     map[[2]string]*simLink
+	listeners map[string]*simListener
+	groups    map[string]int // partition group of each named peer
+	events    []SimEvent
+}
+
+type simLink struct {
+	rng *rand.Rand
+	n   int
+}
+
+func NewSimNetwork(seed int64) *SimNetwork {
+	sn := &SimNetwork{seed: seed}
+	sn.configs = make(map[[2]string]LinkConfig)
+	sn.links = make(map[[2]string]*simLink)
+	sn.listeners = make(map[string]*simListener)
+	return sn
+}
+
+//
+// the seed in $SIM_SEED if set, else a fresh one. tests log
+// it so that a failure can be replayed with SIM_SEED=<seed>.
+//
+func SeedFromEnv() int64 {
+	if s := os.Getenv("SIM_SEED"); s != "" {
+		if seed, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return seed
+		}
+	}
+	return time.Now().UnixNano()
+}
+
+func (sn *SimNetwork) Seed() int64 {
+	return sn.seed
+}
+
+//
+// the settings for every link without its own.
+//
+func (sn *SimNetwork) SetDefault(cfg LinkConfig) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	sn.defaults = cfg
+}
+
+//
+// the settings for messages from peer from to peer to.
+//
+func (sn *SimNetwork) SetLink(from, to string, cfg LinkConfig) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	sn.configs[[2]string{from, to}] = cfg
+}
+
+//
+// split the named peers into groups that can only reach peers
+// in the same group. a named peer left out of every group is
+// cut off from all the others. anonymous callers (clients) are
+// not affected.
+//
+func (sn *SimNetwork) Partition(groups ...[]string) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	sn.groups = make(map[string]int)
+	for g, names := range groups {
+		for _, name := range names {
+			sn.groups[name] = g
+		}
+	}
+}
+
+//
+// undo Partition().
+//
+func (sn *SimNetwork) Heal() {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	sn.groups = nil
+}
+
+//
+// the fate of every call so far, in the order they finished.
+//
+func (sn *SimNetwork) Events() []SimEvent {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	events := make([]SimEvent, len(sn.events))
+	copy(events, sn.events)
+	return events
+}
+
+func (sn *SimNetwork) Listen(addr string) (net.Listener, error) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	l := &simListener{sn: sn, addr: addr}
+	l.conns = make(chan net.Conn)
+	l.done = make(chan struct{})
+	// like a unix socket: a new listener replaces the old one.
+	sn.listeners[addr] = l
+	return l, nil
+}
+
+func (sn *SimNetwork) Call(srv string, rpcname string, args interface{}, reply interface{}) bool {
+	return sn.call(Anonymous, srv, rpcname, args, reply)
+}
+
+//
+// a Transport whose calls come from the peer called name.
+//
+func (sn *SimNetwork) Endpoint(name string) Transport {
+	return &simEndpoint{sn: sn, name: name}
+}
+
+type simEndpoint struct {
+	sn   *SimNetwork
+	name string
+}
+
+func (e *simEndpoint) Call(srv string, rpcname string, args interface{}, reply interface{}) bool {
+	return e.sn.call(e.name, srv, rpcname, args, reply)
+}
+
+func (e *simEndpoint) Listen(addr string) (net.Listener, error) {
+	return e.sn.Listen(addr)
+}
+
+//
+// draw the fate of one call on the link from -> to: whether
+// the request and the reply get through, and their delays.
+//
+func (sn *SimNetwork) roll(from, to string) (int, bool, bool, time.Duration, time.Duration) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	key := [2]string{from, to}
+	link, ok := sn.links[key]
+	if !ok {
+		h := fnv.New64a()
+		h.Write([]byte(from + "->" + to))
+		link = &simLink{rng: rand.New(rand.NewSource(sn.seed ^ int64(h.Sum64())))}
+		sn.links[key] = link
+	}
+	cfg, ok := sn.configs[key]
+	if !ok {
+		cfg = sn.defaults
+	}
+	link.n++
+	delay := func() time.Duration {
+		d := cfg.MinDelay
+		if cfg.MaxDelay > cfg.MinDelay {
+			d += time.Duration(link.rng.Int63n(int64(cfg.MaxDelay - cfg.MinDelay)))
+		}
+		if link.rng.Float64() < cfg.Reorder {
+			d += cfg.MaxDelay
+		}
+		return d
+	}
+	// always draw everything, so that the stream stays in step
+	// whatever the outcome.
+	dropRequest := link.rng.Float64() < cfg.DropRequest
+	dropReply := link.rng.Float64() < cfg.DropReply
+	return link.n, !dropRequest, !dropReply, delay(), delay()
+}
+
+func (sn *SimNetwork) reachable(from, to string) bool {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	if sn.groups == nil || from == Anonymous || to == Anonymous {
+		return true
+	}
+	g1, ok1 := sn.groups[from]
+	g2, ok2 := sn.groups[to]
+	return ok1 && ok2 && g1 == g2
+}
+
+func (sn *SimNetwork) record(ev SimEvent) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	sn.events = append(sn.events, ev)
+}
+
+func (sn *SimNetwork) call(from, srv string, rpcname string, args interface{}, reply interface{}) bool {
+	n, requestOK, replyOK, requestDelay, replyDelay := sn.roll(from, srv)
+	ev := SimEvent{From: from, To: srv, RPC: rpcname, N: n, Delay: requestDelay}
+	time.Sleep(requestDelay)
+	if !sn.reachable(from, srv) {
+		ev.Fate = FatePartitioned
+		sn.record(ev)
+		return false
+	}
+	if !requestOK {
+		ev.Fate = FateDropRequest
+		sn.record(ev)
+		return false
+	}
+	sn.mu.Lock()
+	l := sn.listeners[srv]
+	sn.mu.Unlock()
+	var conn net.Conn
+	if l != nil {
+		conn = l.dial()
+	}
+	if conn == nil {
+		ev.Fate = FateNoServer
+		sn.record(ev)
+		return false
+	}
+	c := NewClient(conn, srv)
+	err := c.Call(rpcname, args, reply)
+	c.Close()
+	ev.Delay += replyDelay
+	time.Sleep(replyDelay)
+	// the partition may have started while the call ran.
+	if !replyOK || !sn.reachable(srv, from) {
+		ev.Fate = FateDropReply
+		sn.record(ev)
+		return false
+	}
+	ev.Fate = FateDelivered
+	sn.record(ev)
+	if err != nil {
+		if _, isServerError := err.(rpc.ServerError); isServerError && err.Error() != ErrDropped {
+			fmt.Println(err)
+		}
+		return false
+	}
+	return true
+}
+
+type simListener struct {
+	sn    *SimNetwork
+	addr  string
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+//
+// hand one end of a new pipe to Accept(), or return nil if
+// the listener is closed.
+//
+func (l *simListener) dial() net.Conn {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client
+	case <-l.done:
+		return nil
+	}
+}
+
+func (l *simListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *simListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.sn.mu.Lock()
+		if l.sn.listeners[l.addr] == l {
+			delete(l.sn.listeners, l.addr)
+		}
+		l.sn.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *simListener) Addr() net.Addr {
+	return simAddr(l.addr)
+}
+
+type simAddr string
+
+func (a simAddr) Network() string {
+	return "sim"
+}
+
+func (a simAddr) String() string {
+	return string(a)
+}
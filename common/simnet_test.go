@@ -0,0 +1,88 @@
+package common
+
+import (
+	"net/rpc"
+	"testing"
+)
+
+type Echo int
+
+func (e *Echo) Echo(args *int, reply *int) error {
+	*reply = *args
+	return nil
+}
+
+//
+// start an Echo server on the simulated network.
+//
+func serveEcho(t *testing.T, sn *SimNetwork, addr string) {
+	rpcs := rpc.NewServer()
+	rpcs.Register(new(Echo))
+	l, err := sn.Listen(addr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go rpcs.ServeConn(conn)
+		}
+	}()
+}
+
+func fates(t *testing.T, seed int64) []bool {
+	sn := NewSimNetwork(seed)
+	sn.SetDefault(LinkConfig{DropRequest: 0.3, DropReply: 0.3})
+	serveEcho(t, sn, "b")
+	a := sn.Endpoint("a")
+	var ok []bool
+	for i := 0; i < 100; i++ {
+		var reply int
+		ok = append(ok, a.Call("b", "Echo.Echo", &i, &reply))
+	}
+	return ok
+}
+
+func TestSimReplay(t *testing.T) {
+	seed := SeedFromEnv()
+	first := fates(t, seed)
+	second := fates(t, seed)
+	delivered := 0
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("seed %v: call %v went differently on replay", seed, i)
+		}
+		if first[i] {
+			delivered++
+		}
+	}
+	if delivered == 0 || delivered == len(first) {
+		t.Fatalf("seed %v: %v of %v calls delivered", seed, delivered, len(first))
+	}
+}
+
+func TestSimPartition(t *testing.T) {
+	sn := NewSimNetwork(SeedFromEnv())
+	for _, addr := range []string{"a", "b", "c"} {
+		serveEcho(t, sn, addr)
+	}
+	x := 7
+	var reply int
+	sn.Partition([]string{"a", "b"}, []string{"c"})
+	if !sn.Endpoint("a").Call("b", "Echo.Echo", &x, &reply) || reply != x {
+		t.Fatalf("a cannot reach b")
+	}
+	if sn.Endpoint("a").Call("c", "Echo.Echo", &x, &reply) {
+		t.Fatalf("a reached c across the partition")
+	}
+	if !sn.Call("c", "Echo.Echo", &x, &reply) {
+		t.Fatalf("an anonymous client cannot reach c")
+	}
+	sn.Heal()
+	if !sn.Endpoint("a").Call("c", "Echo.Echo", &x, &reply) {
+		t.Fatalf("a cannot reach c after Heal")
+	}
+}
@@ -0,0 +1,240 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+//
+// distributed tracing.
+//
+// a trace follows one client request through the stack: the
+// Clerk starts it, and the RPC arguments, Op and Paxos messages
+// on the request's way carry a TraceContext, so that each layer
+// records its span as a child of its caller's. spans are kept
+// in memory while tracing is on (TraceTo(), or the TRACE_FILE
+// environment variable) and FlushTrace() writes them out in the
+// Chrome trace event format, which chrome://tracing and
+// ui.perfetto.dev open: one process per server address, one
+// thread per trace.
+//
+// with tracing off, NewTrace() and StartSpan() return nil, and
+// a nil *Span does nothing.
+//
+
+const MaxSpans = 1 << 20 // spans beyond this are dropped
+
+//
+// what a message carries to continue a trace; the zero value
+// means "not traced".
+//
+type TraceContext struct {
+	TraceId int64
+	SpanId  int64
+}
+
+func (tc TraceContext) Valid() bool {
+	return tc.TraceId != 0
+}
+
+//
+// a value that belongs to a trace, e.g. an Op agreed on
+// through Paxos.
+//
+type Traced interface {
+	TraceContext() TraceContext
+}
+
+//
+// v's trace, if it has one.
+//
+func TraceOf(v interface{}) TraceContext {
+	if t, ok := v.(Traced); ok {
+		return t.TraceContext()
+	}
+	return TraceContext{}
+}
+
+type traceKey struct{}
+
+//
+// ctx, carrying tc along (for APIs that take a context).
+//
+func WithTrace(ctx context.Context, tc TraceContext) context.Context {
+	if !tc.Valid() {
+		return ctx
+	}
+	return context.WithValue(ctx, traceKey{}, tc)
+}
+
+func TraceFrom(ctx context.Context) TraceContext {
+	tc, _ := ctx.Value(traceKey{}).(TraceContext)
+	return tc
+}
+
+type Span struct {
+	tc     TraceContext
+	parent int64
+	where  string // the process it ran in, e.g. a server's address
+	name   string
+	start  time.Time
+}
+
+type finishedSpan struct {
+	Span
+	dur time.Duration
+}
+
+var tracer struct {
+	mu    sync.Mutex
+	on    bool
+	path  string
+	epoch time.Time
+	spans []finishedSpan
+}
+
+func init() {
+	if path := os.Getenv("TRACE_FILE"); path != "" {
+		TraceTo(path)
+	}
+}
+
+//
+// start recording spans, for FlushTrace() to write to path.
+// "" turns tracing off and drops what was recorded.
+//
+func TraceTo(path string) {
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	tracer.on = path != ""
+	tracer.path = path
+	tracer.epoch = time.Now()
+	tracer.spans = nil
+}
+
+func tracing() bool {
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	return tracer.on
+}
+
+//
+// start a new trace, with its root span.
+//
+func NewTrace(where string, name string) *Span {
+	if !tracing() {
+		return nil
+	}
+	return &Span{
+		tc:    TraceContext{TraceId: Nrand(), SpanId: Nrand()},
+		where: where,
+		name:  name,
+		start: time.Now(),
+	}
+}
+
+//
+// start a span that continues parent's trace. nothing is
+// recorded for an untraced parent.
+//
+func StartSpan(parent TraceContext, where string, name string) *Span {
+	if !parent.Valid() || !tracing() {
+		return nil
+	}
+	return &Span{
+		tc:     TraceContext{TraceId: parent.TraceId, SpanId: Nrand()},
+		parent: parent.SpanId,
+		where:  where,
+		name:   name,
+		start:  time.Now(),
+	}
+}
+
+//
+// the context to hand to s's children.
+//
+func (s *Span) Context() TraceContext {
+	if s == nil {
+		return TraceContext{}
+	}
+	return s.tc
+}
+
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	dur := time.Since(s.start)
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	if tracer.on && len(tracer.spans) < MaxSpans {
+		tracer.spans = append(tracer.spans, finishedSpan{*s, dur})
+	}
+}
+
+// one entry of the trace event format.
+type traceEvent struct {
+	Name string            `json:"name"`
+	Ph   string            `json:"ph"`
+	Ts   float64           `json:"ts"` // microseconds
+	Dur  float64           `json:"dur,omitempty"`
+	Pid  int               `json:"pid"`
+	Tid  int               `json:"tid"`
+	Args map[string]string `json:"args,omitempty"`
+}
+
+//
+// write every span recorded so far to the file given to
+// TraceTo(), replacing it. does nothing with tracing off.
+//
+func FlushTrace() error {
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	if !tracer.on {
+		return nil
+	}
+	events := []traceEvent{}
+	pids := make(map[string]int)
+	tids := make(map[int64]int)
+	for _, s := range tracer.spans {
+		pid, ok := pids[s.where]
+		if !ok {
+			pid = len(pids) + 1
+			pids[s.where] = pid
+			events = append(events, traceEvent{Name: "process_name", Ph: "M", Pid: pid,
+				Args: map[string]string{"name": s.where}})
+		}
+		tid, ok := tids[s.tc.TraceId]
+		if !ok {
+			tid = len(tids) + 1
+			tids[s.tc.TraceId] = tid
+		}
+		events = append(events, traceEvent{
+			Name: s.name,
+			Ph:   "X",
+			Ts:   float64(s.start.Sub(tracer.epoch).Nanoseconds()) / 1e3,
+			Dur:  float64(s.dur.Nanoseconds()) / 1e3,
+			Pid:  pid,
+			Tid:  tid,
+			Args: map[string]string{
+				"trace":  fmt.Sprintf("%016x", s.tc.TraceId),
+				"span":   fmt.Sprintf("%016x", s.tc.SpanId),
+				"parent": fmt.Sprintf("%016x", s.parent),
+			},
+		})
+	}
+	f, err := os.Create(tracer.path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	if err := enc.Encode(map[string]interface{}{"traceEvents": events}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
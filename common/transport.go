@@ -0,0 +1,375 @@
+package common
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// a Transport moves RPCs between servers. paxos, shardmaster
+// and shardkv send every RPC through Call() and accept every
+// connection through Listen(), both of which go to
+// DefaultTransport.
+//
+// an address containing a '/' is a unix socket path, anything
+// else (e.g. "10.0.0.1:9000") is a TCP host:port.
+//
+type Transport interface {
+	Call(srv string, rpcname string, args interface{}, reply interface{}) bool
+	Listen(addr string) (net.Listener, error)
+}
+
+//
+// a Transport that can hand out a Transport per caller.
+//
+type EndpointTransport interface {
+	Transport
+	Endpoint(name string) Transport
+}
+
+var (
+	transportMu      sync.Mutex
+	DefaultTransport Transport = NewPooledTransport()
+)
+
+//
+// replace the transport used by Call() and Listen().
+// returns the previous one.
+//
+func SetTransport(t Transport) Transport {
+	transportMu.Lock()
+	defer transportMu.Unlock()
+	old := DefaultTransport
+	DefaultTransport = t
+	return old
+}
+
+func currentTransport() Transport {
+	transportMu.Lock()
+	defer transportMu.Unlock()
+	return DefaultTransport
+}
+
+//
+// listen for RPC connections on addr.
+//
+func Listen(addr string) (net.Listener, error) {
+	return currentTransport().Listen(addr)
+}
+
+//
+// "unix" or "tcp", depending on what addr looks like.
+//
+func Network(addr string) string {
+	if strings.Contains(addr, "/") {
+		return "unix"
+	}
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return "tcp"
+	}
+	return "unix"
+}
+
+const DialTimeout = time.Second
+
+//
+// PooledTransport keeps one persistent connection per peer
+// and multiplexes concurrent calls over it (net/rpc tags each
+// call, so replies may come back in any order). a connection
+// that breaks is dropped and redialed on the next call.
+//
+type PooledTransport struct {
+	mu      sync.Mutex
+	clients map[string]*rpc.Client
+}
+
+func NewPooledTransport() *PooledTransport {
+	t := &PooledTransport{}
+	t.clients = make(map[string]*rpc.Client)
+	return t
+}
+
+func (t *PooledTransport) client(srv string) (*rpc.Client, bool, error) {
+	t.mu.Lock()
+	c, ok := t.clients[srv]
+	t.mu.Unlock()
+	if Network(srv) == "unix" {
+		// a removed socket file makes the server unreachable,
+		// just as it would for a fresh dial.
+		if _, err := os.Stat(srv); err != nil {
+			if ok {
+				t.drop(srv, c)
+			}
+			return nil, false, err
+		}
+	}
+	if ok {
+		return c, true, nil
+	}
+	// dial without holding t.mu, so that a slow peer does
+	// not hold up calls to the others.
+	conn, err := net.DialTimeout(Network(srv), srv, DialTimeout)
+	if err != nil {
+		return nil, false, err
+	}
+	c = NewClient(conn, srv)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if other, ok := t.clients[srv]; ok {
+		c.Close()
+		return other, true, nil
+	}
+	t.clients[srv] = c
+	return c, false, nil
+}
+
+func (t *PooledTransport) drop(srv string, c *rpc.Client) {
+	t.mu.Lock()
+	if t.clients[srv] == c {
+		delete(t.clients, srv)
+	}
+	t.mu.Unlock()
+	c.Close()
+}
+
+func (t *PooledTransport) Call(srv string, rpcname string,
+	args interface{}, reply interface{}) bool {
+	for {
+		c, pooled, errx := t.client(srv)
+		if errx != nil {
+			return false
+		}
+		err := c.Call(rpcname, args, reply)
+		if err == nil {
+			return true
+		}
+		if _, isServerError := err.(rpc.ServerError); isServerError {
+			// the handler failed; the connection is fine.
+			if err.Error() != ErrDropped {
+				fmt.Println(err)
+			}
+			return false
+		}
+		t.drop(srv, c)
+		if pooled && errors.Is(err, rpc.ErrShutdown) {
+			// the pooled connection had already broken, so
+			// the request never went out. redial once.
+			continue
+		}
+		return false
+	}
+}
+
+func (t *PooledTransport) Listen(addr string) (net.Listener, error) {
+	network := Network(addr)
+	if network == "unix" {
+		os.Remove(addr)
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newTrackingListener(l), nil
+}
+
+//
+// drop all pooled connections.
+//
+func (t *PooledTransport) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for srv, c := range t.clients {
+		c.Close()
+		delete(t.clients, srv)
+	}
+}
+
+//
+// a listener that also closes every connection it accepted
+// when it is closed. with persistent connections a killed
+// server would otherwise keep answering on them.
+//
+type trackingListener struct {
+	net.Listener
+	mu     sync.Mutex
+	conns  map[*trackedConn]bool
+	closed bool
+}
+
+type trackedConn struct {
+	net.Conn
+	l *trackingListener
+}
+
+func newTrackingListener(l net.Listener) *trackingListener {
+	tl := &trackingListener{Listener: l}
+	tl.conns = make(map[*trackedConn]bool)
+	return tl
+}
+
+func (tl *trackingListener) Accept() (net.Conn, error) {
+	conn, err := tl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tc := &trackedConn{Conn: conn, l: tl}
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if tl.closed {
+		conn.Close()
+		return nil, errors.New("listener closed")
+	}
+	tl.conns[tc] = true
+	return tc, nil
+}
+
+func (tl *trackingListener) Close() error {
+	err := tl.Listener.Close()
+	tl.mu.Lock()
+	tl.closed = true
+	conns := tl.conns
+	tl.conns = make(map[*trackedConn]bool)
+	tl.mu.Unlock()
+	for tc := range conns {
+		tc.Conn.Close()
+	}
+	return err
+}
+
+func (tc *trackedConn) Close() error {
+	tc.l.mu.Lock()
+	delete(tc.l.conns, tc)
+	tc.l.mu.Unlock()
+	return tc.Conn.Close()
+}
+
+func (tc *trackedConn) CloseWrite() error {
+	return CloseWrite(tc.Conn)
+}
+
+//
+// shut down the writing side of conn, so that the peer sees
+// no reply. for the "unreliable" testing mode.
+//
+func CloseWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return conn.Close()
+}
+
+// error text for calls that an unreliable server dropped.
+const ErrDropped = "rpc: dropped by unreliable server"
+
+var errDropped = errors.New(ErrDropped)
+
+//
+// serve conn like rpc.ServeConn, but roll the dice for each
+// request while isunreliable() holds: discard the request, or
+// run it and discard the reply. a discarded call gets an
+// ErrDropped error back instead of a reply, so that only that
+// call fails and the connection stays open for the others.
+// unreliable servers use this because clients keep their
+// connections open, so a dice roll per accepted connection
+// would hardly ever fire. like ServeConn(), requests are
+// checked against the key for addr, the server's address.
+//
+func ServeUnreliable(rpcs *rpc.Server, conn net.Conn, isunreliable func() bool, addr string) {
+	buf := bufio.NewWriter(conn)
+	codec := &unreliableCodec{
+		gobServerCodec: gobServerCodec{conn, gob.NewDecoder(conn), gob.NewEncoder(buf), buf},
+		isunreliable:   isunreliable,
+		dropReply:      make(map[uint64]bool),
+	}
+	rpcs.ServeCodec(authenticate(codec, addr))
+}
+
+type unreliableCodec struct {
+	gobServerCodec
+	isunreliable func() bool
+	mu           sync.Mutex // guards dropReply and writes to the connection
+	dropReply    map[uint64]bool
+	dropBody     bool // discard the request being read
+}
+
+func (c *unreliableCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.gobServerCodec.ReadRequestHeader(r); err != nil {
+		return err
+	}
+	if c.isunreliable() && (rand.Int63()%1000) < 100 {
+		// discard the request once its body has been read.
+		c.dropBody = true
+	} else if c.isunreliable() && (rand.Int63()%1000) < 200 {
+		// process the request but force discard of reply.
+		c.mu.Lock()
+		c.dropReply[r.Seq] = true
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+//
+// decode the body even of a discarded request, into the
+// argument's real type: decoding into nil can fail on some
+// gob streams, and a failed body leaves the connection
+// unreadable. net/rpc answers the error with ErrDropped.
+//
+func (c *unreliableCodec) ReadRequestBody(body interface{}) error {
+	err := c.gobServerCodec.ReadRequestBody(body)
+	if err == nil && c.dropBody {
+		err = errDropped
+	}
+	c.dropBody = false
+	return err
+}
+
+func (c *unreliableCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dropReply[r.Seq] {
+		delete(c.dropReply, r.Seq)
+		r.Error = ErrDropped
+		body = struct{}{}
+	}
+	return c.gobServerCodec.WriteResponse(r, body)
+}
+
+// the same wire format as the codec inside net/rpc.
+type gobServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+}
+
+func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobServerCodec) Close() error {
+	return c.rwc.Close()
+}
@@ -1,5 +1,7 @@
 package common
 
+import "time"
+
 //
 // define here any data types that you need to access in two packages without
 // creating circular dependencies
@@ -9,10 +11,19 @@ const (
 	OK            = "OK"
 	ErrNoKey      = "ErrNoKey"
 	ErrWrongGroup = "ErrWrongGroup"
+	ErrTimeout    = "ErrTimeout"
 )
 
 type Err string
 
+//
+// how long a server waits for an operation to be agreed on
+// before it answers ErrTimeout, e.g. because its Paxos group
+// has lost its majority; the caller can then try another
+// server.
+//
+const OpTimeout = 2 * time.Second
+
 type DonateDataArgs struct {
 	RequestId    int
 	ConfigNum    int
@@ -29,6 +40,7 @@ type AcceptDataArgs struct {
 	RequestId int
 	ConfigNum int
 	Shards    [NShards]int64
+	Moved     []int // the shards whose data is in Database
 	Database  map[string]string
 	HandledId map[int]bool
 }
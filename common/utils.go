@@ -2,10 +2,8 @@ package common
 
 import (
 	"crypto/rand"
-	"fmt"
 	"hash/crc64"
 	"math/big"
-	"net/rpc"
 )
 
 const NShards = 16
@@ -43,19 +41,23 @@ func Key2Shard(key string) int {
 // error after a while if the server is dead.
 // don't provide your own time-out mechanism.
 //
+// the RPC goes through DefaultTransport (see transport.go).
+//
 func Call(srv string, rpcname string,
 	args interface{}, reply interface{}) bool {
-	c, errx := rpc.Dial("unix", srv)
-	if errx != nil {
-		return false
-	}
-	defer c.Close()
+	return currentTransport().Call(srv, rpcname, args, reply)
+}
 
-	err := c.Call(rpcname, args, reply)
-	if err == nil {
-		return true
+//
+// like Call(), for calls a server makes. from is the server's
+// own address, so that a Transport that can tell callers apart
+// (e.g. PartitionController, SimNetwork) knows who is calling.
+//
+func CallAs(from string, srv string, rpcname string,
+	args interface{}, reply interface{}) bool {
+	t := currentTransport()
+	if et, ok := t.(EndpointTransport); ok {
+		return et.Endpoint(from).Call(srv, rpcname, args, reply)
 	}
-
-	fmt.Println(err)
-	return false
+	return t.Call(srv, rpcname, args, reply)
 }
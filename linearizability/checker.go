@@ -0,0 +1,312 @@
+package linearizability
+
+//
+// a linearizability checker in the style of Porcupine: the
+// Wing & Gong search with Lowe's memoization, run separately
+// on each partition of the history (e.g. each key) that the
+// model says can be checked on its own.
+//
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+//
+// one completed call, with its invocation and response times.
+//
+type Operation struct {
+	ClientId int
+	Input    interface{}
+	Call     int64 // invocation time
+	Output   interface{}
+	Return   int64 // response time
+}
+
+//
+// a sequential specification.
+//
+type Model struct {
+	// split a history into parts that are linearizable
+	// together iff each one is. nil means no split.
+	Partition func(history []Operation) [][]Operation
+	// the initial state.
+	Init func() interface{}
+	// can an operation with input and output happen in state?
+	// if so, the state after it.
+	Step func(state interface{}, input interface{}, output interface{}) (bool, interface{})
+	// are two states the same?
+	Equal func(state1, state2 interface{}) bool
+	// for counter-examples.
+	DescribeOperation func(input interface{}, output interface{}) string
+}
+
+//
+// why a history is not linearizable: the part that failed,
+// the longest linearization of a prefix of it that was found,
+// and the operations none of which could come next.
+//
+type Info struct {
+	Partition []Operation
+	Longest   []Operation
+	Stuck     []Operation
+}
+
+func (info Info) Describe(m Model) string {
+	var b strings.Builder
+	describe := func(op Operation) string {
+		return fmt.Sprintf("client %v [%v, %v] %v", op.ClientId, op.Call, op.Return,
+			m.DescribeOperation(op.Input, op.Output))
+	}
+	fmt.Fprintf(&b, "history of %v operations is not linearizable.\n", len(info.Partition))
+	fmt.Fprintf(&b, "longest linearizable prefix:\n")
+	for _, op := range info.Longest {
+		fmt.Fprintf(&b, "  %v\n", describe(op))
+	}
+	fmt.Fprintf(&b, "none of these can come next:\n")
+	for _, op := range info.Stuck {
+		fmt.Fprintf(&b, "  %v\n", describe(op))
+	}
+	return b.String()
+}
+
+//
+// check history against m. on failure, Info describes a
+// counter-example.
+//
+func CheckOperations(m Model, history []Operation) (bool, Info) {
+	result, info := CheckOperationsTimeout(m, history, 0)
+	return result == Ok, info
+}
+
+type CheckResult string
+
+const (
+	Ok      CheckResult = "Ok"
+	Illegal CheckResult = "Illegal"
+	Unknown CheckResult = "Unknown" // gave up
+)
+
+//
+// like CheckOperations(), but give up after timeout (0 for
+// never). the search is exponential in the worst case, e.g.
+// for many concurrent Appends to one key.
+//
+func CheckOperationsTimeout(m Model, history []Operation, timeout time.Duration) (CheckResult, Info) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	parts := [][]Operation{history}
+	if m.Partition != nil {
+		parts = m.Partition(history)
+	}
+	result := Ok
+	for _, part := range parts {
+		switch r, info := checkPart(m, part, deadline); r {
+		case Illegal:
+			return Illegal, info
+		case Unknown:
+			// another part may still turn out Illegal.
+			result = Unknown
+		}
+	}
+	return result, Info{}
+}
+
+//
+// the history as a doubly-linked list of call and return
+// entries in time order; linearizing an operation lifts its
+// two entries out of the list.
+//
+type entry struct {
+	isCall bool
+	id     int
+	time   int64
+	match  *entry // the call's return entry
+	prev   *entry
+	next   *entry
+}
+
+func makeEntries(history []Operation) *entry {
+	var entries []*entry
+	for id, op := range history {
+		ret := &entry{id: id, time: op.Return}
+		call := &entry{isCall: true, id: id, time: op.Call, match: ret}
+		entries = append(entries, call, ret)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].time != entries[j].time {
+			return entries[i].time < entries[j].time
+		}
+		// calls first, so that operations that touch are concurrent.
+		return entries[i].isCall && !entries[j].isCall
+	})
+	head := &entry{id: -1}
+	last := head
+	for _, e := range entries {
+		last.next = e
+		e.prev = last
+		last = e
+	}
+	return head
+}
+
+func lift(e *entry) {
+	e.prev.next = e.next
+	if e.next != nil {
+		e.next.prev = e.prev
+	}
+	m := e.match
+	m.prev.next = m.next
+	if m.next != nil {
+		m.next.prev = m.prev
+	}
+}
+
+func unlift(e *entry) {
+	m := e.match
+	m.prev.next = m
+	if m.next != nil {
+		m.next.prev = m
+	}
+	e.prev.next = e
+	if e.next != nil {
+		e.next.prev = e
+	}
+}
+
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i int) {
+	b[i/64] |= 1 << uint(i%64)
+}
+
+func (b bitset) clear(i int) {
+	b[i/64] &^= 1 << uint(i%64)
+}
+
+func (b bitset) clone() bitset {
+	c := make(bitset, len(b))
+	copy(c, b)
+	return c
+}
+
+func (b bitset) equals(c bitset) bool {
+	for i := range b {
+		if b[i] != c[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bitset) hash() uint64 {
+	h := uint64(len(b))
+	for _, w := range b {
+		h = h*1000003 ^ w
+	}
+	return h
+}
+
+type cacheEntry struct {
+	linearized bitset
+	state      interface{}
+}
+
+type frame struct {
+	e     *entry
+	state interface{}
+}
+
+func checkPart(m Model, history []Operation, deadline time.Time) (CheckResult, Info) {
+	head := makeEntries(history)
+	state := m.Init()
+	linearized := newBitset(len(history))
+	cache := make(map[uint64][]cacheEntry)
+	seen := func(b bitset, s interface{}) bool {
+		for _, c := range cache[b.hash()] {
+			if c.linearized.equals(b) && m.Equal(c.state, s) {
+				return true
+			}
+		}
+		return false
+	}
+	var stack []frame
+	var longest []frame
+	e := head.next
+	for steps := 0; head.next != nil; steps++ {
+		if steps%(1<<14) == 0 && !deadline.IsZero() && time.Now().After(deadline) {
+			return Unknown, Info{}
+		}
+		if e.isCall {
+			ok, next := m.Step(state, history[e.id].Input, history[e.id].Output)
+			if ok {
+				after := linearized.clone()
+				after.set(e.id)
+				if !seen(after, next) {
+					h := after.hash()
+					cache[h] = append(cache[h], cacheEntry{after, next})
+					stack = append(stack, frame{e, state})
+					state = next
+					linearized = after
+					lift(e)
+					e = head.next
+					continue
+				}
+			}
+			e = e.next
+		} else {
+			// an operation has returned that cannot be placed yet.
+			if len(stack) > len(longest) {
+				longest = append([]frame(nil), stack...)
+			}
+			if len(stack) == 0 {
+				return Illegal, failure(history, longest)
+			}
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			state = top.state
+			linearized = linearized.clone()
+			linearized.clear(top.e.id)
+			unlift(top.e)
+			e = top.e.next
+		}
+	}
+	return Ok, Info{}
+}
+
+//
+// describe the failure: the longest linearization, and the
+// operations that could have come after it but did not fit.
+//
+func failure(history []Operation, longest []frame) Info {
+	info := Info{Partition: history}
+	placed := make(map[int]bool)
+	for _, f := range longest {
+		info.Longest = append(info.Longest, history[f.e.id])
+		placed[f.e.id] = true
+	}
+	// everything unplaced that was invoked before the first
+	// unplaced operation returned.
+	var firstReturn int64
+	found := false
+	for id, op := range history {
+		if !placed[id] && (!found || op.Return < firstReturn) {
+			firstReturn = op.Return
+			found = true
+		}
+	}
+	for id, op := range history {
+		if !placed[id] && op.Call <= firstReturn {
+			info.Stuck = append(info.Stuck, op)
+		}
+	}
+	return info
+}
@@ -0,0 +1,72 @@
+package linearizability
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func put(client int, key, value string, call, ret int64) Operation {
+	return Operation{client, KvInput{PutOp, key, value}, call, "", ret}
+}
+
+func get(client int, key, value string, call, ret int64) Operation {
+	return Operation{client, KvInput{GetOp, key, ""}, call, value, ret}
+}
+
+func appendOp(client int, key, value string, call, ret int64) Operation {
+	return Operation{client, KvInput{AppendOp, key, value}, call, "", ret}
+}
+
+func TestLinearizable(t *testing.T) {
+	history := []Operation{
+		put(1, "x", "a", 0, 10),
+		// concurrent with the put: may see either value.
+		get(2, "x", "", 5, 15),
+		appendOp(3, "x", "b", 12, 20),
+		get(2, "x", "ab", 21, 30),
+		get(1, "y", "", 0, 100),
+	}
+	if ok, info := CheckOperations(KvModel, history); !ok {
+		t.Fatalf("rejected a linearizable history:\n%v", info.Describe(KvModel))
+	}
+}
+
+func TestNotLinearizable(t *testing.T) {
+	history := []Operation{
+		put(1, "x", "a", 0, 10),
+		put(1, "x", "b", 11, 20),
+		// a stale read after the second put returned.
+		get(2, "x", "a", 25, 30),
+		put(1, "y", "c", 0, 10),
+	}
+	ok, info := CheckOperations(KvModel, history)
+	if ok {
+		t.Fatalf("accepted a stale read")
+	}
+	if len(info.Partition) != 3 || len(info.Longest) != 2 {
+		t.Fatalf("wrong counter-example:\n%v", info.Describe(KvModel))
+	}
+	if !strings.Contains(info.Describe(KvModel), `Get("x") -> "a"`) {
+		t.Fatalf("counter-example misses the stale read:\n%v", info.Describe(KvModel))
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	// 20 concurrent appends, then a read no order explains:
+	// the search has to try every one of them.
+	var history []Operation
+	for i := 0; i < 20; i++ {
+		history = append(history, appendOp(i, "x", strconv.Itoa(i), 0, 10))
+	}
+	history = append(history, get(20, "x", "impossible", 20, 30))
+	start := time.Now()
+	result, _ := CheckOperationsTimeout(KvModel, history, 100*time.Millisecond)
+	if result != Unknown {
+		t.Fatalf("expected Unknown, got %v", result)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("took %v to give up", time.Since(start))
+	}
+}
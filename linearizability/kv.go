@@ -0,0 +1,73 @@
+package linearizability
+
+import (
+	"fmt"
+)
+
+//
+// a model of a key/value store with Get, Put and Append.
+//
+
+const (
+	GetOp    = "Get"
+	PutOp    = "Put"
+	AppendOp = "Append"
+)
+
+type KvInput struct {
+	Op    string // GetOp, PutOp or AppendOp
+	Key   string
+	Value string
+}
+
+//
+// Output is the value Get returned; unused for Put and Append.
+//
+var KvModel = Model{
+	Partition: func(history []Operation) [][]Operation {
+		byKey := make(map[string][]Operation)
+		var keys []string
+		for _, op := range history {
+			key := op.Input.(KvInput).Key
+			if _, ok := byKey[key]; !ok {
+				keys = append(keys, key)
+			}
+			byKey[key] = append(byKey[key], op)
+		}
+		var parts [][]Operation
+		for _, key := range keys {
+			parts = append(parts, byKey[key])
+		}
+		return parts
+	},
+	Init: func() interface{} {
+		// a key that was never written reads as "".
+		return ""
+	},
+	Step: func(state interface{}, input interface{}, output interface{}) (bool, interface{}) {
+		in := input.(KvInput)
+		st := state.(string)
+		switch in.Op {
+		case GetOp:
+			return output.(string) == st, st
+		case PutOp:
+			return true, in.Value
+		default:
+			return true, st + in.Value
+		}
+	},
+	Equal: func(state1, state2 interface{}) bool {
+		return state1 == state2
+	},
+	DescribeOperation: func(input interface{}, output interface{}) string {
+		in := input.(KvInput)
+		switch in.Op {
+		case GetOp:
+			return fmt.Sprintf("Get(%q) -> %q", in.Key, output)
+		case PutOp:
+			return fmt.Sprintf("Put(%q, %q)", in.Key, in.Value)
+		default:
+			return fmt.Sprintf("Append(%q, %q)", in.Key, in.Value)
+		}
+	},
+}
@@ -0,0 +1,179 @@
+package paxos
+
+import (
+	"fmt"
+	"sort"
+
+	"umich.edu/eecs491/proj5/common"
+)
+
+//
+// agreement auditing, for tests: gather every peer's instances
+// (see Inspect) and report anything that Paxos promises cannot
+// happen:
+//
+// - two peers decided different values for the same seq.
+// - a value is decided, yet none of a majority of members that
+//   still remember the seq holds it as its accepted value.
+// - a peer forgot an instance that another peer has decided but
+//   not yet called Done() for, i.e. Min() ran ahead, and no
+//   snapshot (see SetSnapshot) covers it.
+//
+// values are compared in their Inspect (fmt) form. peers that
+// cannot be reached are left out.
+//
+
+//
+// audit the peers of one group in this process.
+//
+func Audit(pxa []*Paxos) []string {
+	inspect := func(i int) (InspectReply, bool) {
+		var reply InspectReply
+		if pxa[i] == nil || pxa[i].isdead() {
+			return reply, false
+		}
+		pxa[i].Inspect(&InspectArgs{From: 0, To: -1}, &reply)
+		return reply, true
+	}
+	return audit(len(pxa), inspect)
+}
+
+//
+// audit the peers of one group over RPC: ports are the peers'
+// ports, or those of the servers they share an rpc.Server with.
+//
+func AuditPorts(ports []string) []string {
+	inspect := func(i int) (InspectReply, bool) {
+		// a few tries, for servers with an unreliable network.
+		for try := 0; try < 3; try++ {
+			var reply InspectReply
+			if common.Call(ports[i], "Paxos.Inspect", &InspectArgs{From: 0, To: -1}, &reply) {
+				return reply, true
+			}
+		}
+		return InspectReply{}, false
+	}
+	return audit(len(ports), inspect)
+}
+
+func audit(npeers int, inspect func(i int) (InspectReply, bool)) []string {
+	// two rounds, so that every peer is also seen after every
+	// other peer's first snapshot (for the Min() check).
+	var rounds [2][]*InspectReply
+	for r := range rounds {
+		rounds[r] = make([]*InspectReply, npeers)
+		for i := 0; i < npeers; i++ {
+			if reply, ok := inspect(i); ok {
+				rounds[r][i] = &reply
+			}
+		}
+	}
+	var problems []string
+	problems = append(problems, auditDecided(rounds[1])...)
+	problems = append(problems, auditForgotten(rounds[0], rounds[1])...)
+	return problems
+}
+
+func byPeer(state *InspectReply) map[int]InstanceInfo {
+	insts := make(map[int]InstanceInfo)
+	for _, inst := range state.Instances {
+		insts[inst.Seq] = inst
+	}
+	return insts
+}
+
+//
+// disagreements, and decided values that no acceptor holds.
+//
+func auditDecided(states []*InspectReply) []string {
+	var problems []string
+	insts := make([]map[int]InstanceInfo, len(states))
+	decided := make(map[int]string)
+	decidedBy := make(map[int]string)
+	var members []string
+	for i, state := range states {
+		if state == nil {
+			continue
+		}
+		insts[i] = byPeer(state)
+		members = state.Members
+		for _, inst := range state.Instances {
+			if !inst.Decided {
+				continue
+			}
+			port := state.Peers[state.Me]
+			if v, ok := decided[inst.Seq]; !ok {
+				decided[inst.Seq] = inst.V
+				decidedBy[inst.Seq] = port
+			} else if v != inst.V {
+				problems = append(problems, fmt.Sprintf(
+					"seq %v: %v decided %v but %v decided %v",
+					inst.Seq, decidedBy[inst.Seq], v, port, inst.V))
+			}
+		}
+	}
+
+	isMember := make(map[string]bool)
+	for _, m := range members {
+		isMember[m] = true
+	}
+	for _, seq := range sortedSeqs(decided) {
+		v := decided[seq]
+		remembering := 0
+		held := false
+		for i, state := range states {
+			if state == nil || !isMember[state.Peers[state.Me]] || seq <= state.Forgotten {
+				continue
+			}
+			remembering += 1
+			if inst, ok := insts[i][seq]; ok && inst.HasNa && inst.Va == v {
+				held = true
+			}
+		}
+		// a majority accepted v, so any majority includes one of them.
+		if remembering > len(members)/2 && !held {
+			problems = append(problems, fmt.Sprintf(
+				"seq %v: %v is decided but no acceptor holds it", seq, v))
+		}
+	}
+	return problems
+}
+
+//
+// instances forgotten by one peer (in its earlier snapshot)
+// that another peer (in its later one) still needs.
+//
+func auditForgotten(before []*InspectReply, after []*InspectReply) []string {
+	var problems []string
+	for _, a := range before {
+		if a == nil {
+			continue
+		}
+		isMember := make(map[string]bool)
+		for _, m := range a.Members {
+			isMember[m] = true
+		}
+		for _, b := range after {
+			if b == nil || !isMember[b.Peers[b.Me]] {
+				continue
+			}
+			for _, inst := range b.Instances {
+				if inst.Decided && inst.Seq <= a.Forgotten && inst.Seq > b.LocalDone && inst.Seq > a.Snapshot {
+					problems = append(problems, fmt.Sprintf(
+						"seq %v: %v forgot it, but %v decided it and is not Done() with it",
+						inst.Seq, a.Peers[a.Me], b.Peers[b.Me]))
+				}
+			}
+		}
+	}
+	return problems
+}
+
+func sortedSeqs(m map[int]string) []int {
+	var seqs []int
+	for seq := range m {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	return seqs
+}
@@ -0,0 +1,155 @@
+package paxos
+
+import (
+	"math/rand"
+	"time"
+)
+
+//
+// catch-up for peers that missed Learn messages.
+//
+// every peer tracks the highest instance it has heard of from
+// anyone (maxKnown). a background goroutine periodically asks a
+// random member for the decided values between the first hole in
+// the local log and maxKnown, and learns them. the reply also
+// carries the other peer's maxKnown, so a peer that heard nothing
+// at all (e.g. it was partitioned) still finds out how far
+// behind it is, or that it has fallen behind the other peer's
+// snapshot.
+//
+
+const (
+	CatchUpInterval = 100 * time.Millisecond
+	CatchUpBatch    = 100 // instances asked for per CatchUp RPC
+)
+
+type CatchUpArgs struct {
+	From int
+	To   int
+}
+
+type DecidedInstance struct {
+	Seq int
+	V   interface{}
+}
+
+type CatchUpReply struct {
+	Decided   []DecidedInstance // the decided instances in [From, To]
+	Max       int               // highest instance the responder knows of
+	Forgotten int               // the responder has forgotten every instance <= Forgotten
+	Reconfigs map[int]Reconfig  // with WithReconfig: every Reconfig decided so far
+}
+
+//
+// handler: report the decided instances in [args.From, args.To].
+//
+func (px *Paxos) CatchUp(args *CatchUpArgs, reply *CatchUpReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	for seq := args.From; seq <= args.To; seq++ {
+		if v, ok := px.impl.instances.decided(seq); ok {
+			reply.Decided = append(reply.Decided, DecidedInstance{seq, v})
+		}
+	}
+	reply.Max = px.impl.maxKnown
+	reply.Forgotten = px.impl.instances.base - 1
+	if px.impl.reconfigurable {
+		reply.Reconfigs = make(map[int]Reconfig)
+		for seq, rc := range px.impl.reconfigs {
+			reply.Reconfigs[seq] = rc
+		}
+	}
+	return nil
+}
+
+//
+// note that some peer knows of instance seq. caller holds px.mu.
+//
+func (px *Paxos) noteSeq(seq int) {
+	if seq > px.impl.maxKnown {
+		px.impl.maxKnown = seq
+	}
+}
+
+func (px *Paxos) catchUpLoop() {
+	for !px.isdead() {
+		time.Sleep(CatchUpInterval)
+		px.catchUp()
+	}
+}
+
+//
+// ask one random member for the decided instances this peer
+// is missing, and learn them.
+//
+func (px *Paxos) catchUp() {
+	px.mu.Lock()
+	from := px.impl.decidedThrough + 1
+	if from <= px.impl.localDone {
+		from = px.impl.localDone + 1
+	}
+	to := px.impl.maxKnown
+	if to >= from+CatchUpBatch {
+		to = from + CatchUpBatch - 1
+	}
+	// with nothing missing, an empty range still brings back
+	// the other peer's maxKnown.
+	var others []string
+	for _, idx := range px.impl.epochs[len(px.impl.epochs)-1].Members {
+		if idx != px.me {
+			others = append(others, px.peers[idx])
+		}
+	}
+	px.mu.Unlock()
+	if len(others) == 0 {
+		return
+	}
+
+	args := &CatchUpArgs{From: from, To: to}
+	var reply CatchUpReply
+	if !px.call(others[rand.Intn(len(others))], "Paxos.CatchUp", args, &reply) {
+		return
+	}
+
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	px.noteSeq(reply.Max)
+	if px.impl.reconfigurable {
+		changed := false
+		for seq, rc := range reply.Reconfigs {
+			if _, known := px.impl.reconfigs[seq]; !known {
+				px.impl.reconfigs[seq] = rc
+				changed = true
+				if !px.persist(walRecord{Kind: recReconfig, Seq: seq, V: rc}) {
+					return
+				}
+			}
+		}
+		if changed {
+			px.rebuildMembership()
+		}
+	}
+	for _, d := range reply.Decided {
+		if _, ok := px.impl.instances.decided(d.Seq); ok || d.Seq <= px.impl.localDone {
+			continue
+		}
+		px.impl.instances.decide(d.Seq, d.V)
+		px.noteDecided(d.Seq, d.V)
+		if !px.persist(walRecord{Kind: recDecide, Seq: d.Seq, V: d.V}) {
+			return
+		}
+	}
+	// instances everyone else has forgotten were applied by
+	// every member; only a peer that joined later can be missing
+	// them, and it never needs them (their Reconfigs came above).
+	if px.impl.reconfigurable && reply.Forgotten > px.impl.decidedThrough {
+		px.advanceDecided(reply.Forgotten)
+	}
+	// instances the other peer forgot thanks to a snapshot (see
+	// SetSnapshot): this peer cannot learn them any more either.
+	if reply.Forgotten >= from {
+		px.advanceDecided(reply.Forgotten)
+		px.dropWaiters(reply.Forgotten)
+		px.impl.instances.forget(reply.Forgotten + 1)
+	}
+}
@@ -0,0 +1,84 @@
+package paxos
+
+import (
+	"time"
+)
+
+//
+// run call(idx) for every peer index in targets in parallel, and
+// return as soon as need of them have returned true (true), or as
+// soon as that can no longer happen (false). calls still running
+// at that point finish in the background, so call must guard
+// whatever it shares with the caller.
+//
+func (px *Paxos) fanOut(targets []int, need int, call func(idx int) bool) bool {
+	npeers := len(targets)
+	results := make(chan bool, npeers) // stragglers never block
+	for _, idx := range targets {
+		go func(idx int) {
+			results <- call(idx)
+		}(idx)
+	}
+	got := 0
+	for answered := 1; answered <= npeers; answered++ {
+		if <-results {
+			got += 1
+		}
+		if got >= need {
+			return true
+		}
+		if got+npeers-answered < need {
+			return false
+		}
+	}
+	return false
+}
+
+const (
+	PhasePrepare = "prepare"
+	PhaseAccept  = "accept"
+	PhaseLearn   = "learn"
+)
+
+//
+// latency of one proposer phase, from the first RPC sent
+// until a majority answered (or could no longer answer).
+//
+type PhaseStats struct {
+	Count int
+	Total time.Duration
+	Max   time.Duration
+}
+
+func (ps PhaseStats) Mean() time.Duration {
+	if ps.Count == 0 {
+		return 0
+	}
+	return ps.Total / time.Duration(ps.Count)
+}
+
+func (px *Paxos) recordPhase(phase string, d time.Duration) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	ps := px.impl.phaseStats[phase]
+	ps.Count += 1
+	ps.Total += d
+	if d > ps.Max {
+		ps.Max = d
+	}
+	px.impl.phaseStats[phase] = ps
+}
+
+//
+// per-phase latency seen by this peer's proposers so far,
+// keyed by PhasePrepare, PhaseAccept and PhaseLearn.
+//
+func (px *Paxos) PhaseStats() map[string]PhaseStats {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	stats := make(map[string]PhaseStats)
+	for phase, ps := range px.impl.phaseStats {
+		stats[phase] = ps
+	}
+	return stats
+}
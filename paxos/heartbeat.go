@@ -0,0 +1,132 @@
+package paxos
+
+import (
+	"time"
+)
+
+//
+// Done() gossip.
+//
+// Min() can only rise once every member's and learner's Done()
+// value has been heard. besides the Learn replies, every Prepare
+// and Accept carries the sender's Done() value both ways, and a
+// background heartbeat exchanges it with every member and learner
+// even when nothing is being agreed on. a peer that has not been
+// heard from for DeadAfter is reported by Suspects(): it still
+// holds Min() back, since it may come back and need the instances
+// it missed, but the application can see why memory is not being
+// freed.
+//
+
+const (
+	HeartbeatInterval = 100 * time.Millisecond
+	DeadAfter         = 5 * time.Second
+)
+
+type HeartbeatArgs struct {
+	From string // the sender's port
+	Done int
+}
+
+type HeartbeatReply struct {
+	Done int
+}
+
+func (px *Paxos) Heartbeat(args *HeartbeatArgs, reply *HeartbeatReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	px.heard(args.From, args.Done)
+	reply.Done = px.impl.localDone
+	return nil
+}
+
+//
+// record that peer is alive and reported done. caller holds px.mu.
+//
+func (px *Paxos) heard(peer string, done int) {
+	px.impl.lastHeard[peer] = time.Now()
+	for idx, p := range px.peers {
+		// a straggler may answer after a later message did.
+		if p == peer && done > px.impl.peersDone[idx] {
+			px.impl.peersDone[idx] = done
+		}
+	}
+}
+
+//
+// record the Done() value a peer reported.
+//
+func (px *Paxos) noteDone(peer string, done int) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	px.heard(peer, done)
+}
+
+//
+// this peer's port and Done() value, for outgoing messages.
+//
+func (px *Paxos) doneInfo() (string, int) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return px.peers[px.me], px.impl.localDone
+}
+
+func (px *Paxos) heartbeatLoop() {
+	for !px.isdead() {
+		time.Sleep(HeartbeatInterval)
+		px.heartbeat()
+		px.Forget()
+	}
+}
+
+//
+// send a heartbeat to every other member and learner that is
+// not still working on the previous one.
+//
+func (px *Paxos) heartbeat() {
+	px.mu.Lock()
+	args := &HeartbeatArgs{From: px.peers[px.me], Done: px.impl.localDone}
+	var targets []string
+	for _, idx := range px.followers() {
+		peer := px.peers[idx]
+		if idx != px.me && !px.impl.beating[peer] {
+			px.impl.beating[peer] = true
+			targets = append(targets, peer)
+		}
+	}
+	px.mu.Unlock()
+	for _, peer := range targets {
+		go func(peer string) {
+			var reply HeartbeatReply
+			ok := px.call(peer, "Paxos.Heartbeat", args, &reply)
+			px.mu.Lock()
+			defer px.mu.Unlock()
+			delete(px.impl.beating, peer)
+			if ok {
+				px.heard(peer, reply.Done)
+			}
+		}(peer)
+	}
+}
+
+//
+// the members and learners this peer has not heard from for DeadAfter.
+// they hold Min() back until they come back (or are removed,
+// see WithReconfig).
+//
+func (px *Paxos) Suspects() []string {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	var suspects []string
+	for _, idx := range px.followers() {
+		peer := px.peers[idx]
+		last, ok := px.impl.lastHeard[peer]
+		if !ok {
+			last = px.impl.started
+		}
+		if idx != px.me && time.Since(last) > DeadAfter {
+			suspects = append(suspects, peer)
+		}
+	}
+	return suspects
+}
@@ -0,0 +1,89 @@
+package paxos
+
+import (
+	"fmt"
+)
+
+//
+// introspection, for debugging a stuck group without
+// uncommenting log.Printf()s (see cmd/paxosdump).
+//
+// values travel as fmt strings, so that the caller need not
+// know (and gob.Register) the application's types.
+//
+
+type InspectArgs struct {
+	From int // first instance to report
+	To   int // last instance to report, -1 for Max()
+}
+
+type InstanceInfo struct {
+	Seq     int
+	HasNp   bool
+	Np      ProposalNumber
+	HasNa   bool
+	Na      ProposalNumber
+	Va      string
+	Decided bool
+	V       string
+}
+
+type InspectReply struct {
+	Me        int
+	Peers     []string
+	Members   []string
+	Learners  []string
+	LocalDone int
+	PeersDone []int // indexed like Peers
+	Min       int
+	Max       int
+	Forgotten int    // every instance <= Forgotten has been forgotten
+	Snapshot  int    // the application's snapshot covers every instance <= Snapshot
+	LeaderId  string // the multi-paxos leader, as far as this peer knows
+	Leased    string // the lease holder, as far as this peer knows
+	Proposers int    // live proposer goroutines
+	Instances []InstanceInfo
+}
+
+func (px *Paxos) Inspect(args *InspectArgs, reply *InspectReply) error {
+	reply.Min = px.Min()
+	reply.Members = px.Members()
+	reply.Learners = px.Learners()
+	reply.Leased = px.LeaseHolder()
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	reply.Me = px.me
+	reply.Peers = append([]string(nil), px.peers...)
+	reply.LocalDone = px.impl.localDone
+	reply.PeersDone = append([]int(nil), px.impl.peersDone...)
+	reply.Max = px.impl.instances.max
+	reply.Forgotten = px.impl.instances.base - 1
+	reply.Snapshot = px.impl.snapSeq
+	reply.LeaderId = px.impl.leaderId
+	reply.Proposers = len(px.impl.proposers)
+	to := args.To
+	if to < 0 {
+		to = px.impl.maxKnown
+	}
+	px.impl.instances.each(args.From, func(seq int, inst *instance) {
+		if seq > to {
+			return
+		}
+		info := InstanceInfo{
+			Seq:     seq,
+			HasNp:   inst.hasNp,
+			Np:      inst.np,
+			HasNa:   inst.hasNa,
+			Na:      inst.na,
+			Decided: inst.decided,
+		}
+		if inst.hasNa {
+			info.Va = fmt.Sprintf("%+v", inst.va)
+		}
+		if inst.decided {
+			info.V = fmt.Sprintf("%+v", inst.v)
+		}
+		reply.Instances = append(reply.Instances, info)
+	})
+	return nil
+}
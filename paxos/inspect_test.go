@@ -0,0 +1,59 @@
+package paxos
+
+import (
+	"net/rpc"
+	"strconv"
+	"testing"
+
+	"umich.edu/eecs491/proj5/common"
+)
+
+func TestInspect(t *testing.T) {
+	pxa, pxh := makePeers("inspect", 3, nil)
+	defer cleanup(pxa)
+	for seq := 0; seq < 3; seq++ {
+		pxa[0].Start(seq, seq*10)
+		waitn(t, pxa, seq, 3)
+	}
+	pxa[1].Done(0)
+
+	// over RPC, as paxosdump does.
+	var reply InspectReply
+	if !common.Call(pxh[1], "Paxos.Inspect", &InspectArgs{From: 0, To: -1}, &reply) {
+		t.Fatalf("Inspect RPC failed")
+	}
+	if reply.Me != 1 || len(reply.Peers) != 3 || reply.Peers[1] != pxh[1] {
+		t.Fatalf("Inspect: Me %v Peers %v", reply.Me, reply.Peers)
+	}
+	if reply.LocalDone != 0 || reply.PeersDone[1] != 0 || reply.Max != 2 {
+		t.Fatalf("Inspect: LocalDone %v PeersDone %v Max %v", reply.LocalDone, reply.PeersDone, reply.Max)
+	}
+	// the others are not Done(), so nothing is forgotten.
+	if reply.Forgotten != -1 || len(reply.Instances) != 3 {
+		t.Fatalf("Inspect: %v instances, %v forgotten", len(reply.Instances), reply.Forgotten)
+	}
+	for i, inst := range reply.Instances {
+		if inst.Seq != i || !inst.Decided || inst.V != strconv.Itoa(i*10) {
+			t.Fatalf("Inspect: instance %+v", inst)
+		}
+	}
+
+	// an instance accepted but not decided, on a peer that does
+	// not listen.
+	px := Make([]string{port("inspect", 3)}, 0, rpc.NewServer())
+	defer px.Kill()
+	var areply AcceptReply
+	px.Accept(&AcceptArgs{Seq: 4, N: ProposalNumber{2, "x"}, V: "a", Done: InitDone}, &areply)
+	reply = InspectReply{}
+	px.Inspect(&InspectArgs{From: 0, To: -1}, &reply)
+	if len(reply.Instances) != 1 {
+		t.Fatalf("Inspect: instances %+v", reply.Instances)
+	}
+	inst := reply.Instances[0]
+	if inst.Seq != 4 || !inst.HasNa || inst.Na != (ProposalNumber{2, "x"}) || inst.Va != "a" || inst.Decided {
+		t.Fatalf("Inspect: instance %+v", inst)
+	}
+	if reply.Max != -1 {
+		t.Fatalf("Inspect: Max %v with nothing decided", reply.Max)
+	}
+}
@@ -0,0 +1,195 @@
+package paxos
+
+import (
+	"sort"
+)
+
+//
+// per-instance acceptor and learner state, kept in a slice
+// indexed by seq - base. everything below base has been
+// forgotten, so Forget() only ever drops a prefix, and Max(),
+// Min() and the Forgotten check in Status() are O(1).
+//
+// the slice spans base..highest seq touched; an instance more
+// than maxDense past its end (a Start() or RPC for a far off
+// seq) goes in a map instead, and moves into the slice once the
+// slice grows up to it.
+//
+
+const maxDense = 1 << 16
+
+type instance struct {
+	hasNp   bool
+	np      ProposalNumber
+	hasNa   bool
+	na      ProposalNumber
+	va      interface{}
+	decided bool
+	v       interface{}
+}
+
+type instanceStore struct {
+	base  int               // seq of slots[0]; every seq < base is forgotten
+	slots []*instance       // nil for instances with no state yet
+	far   map[int]*instance // instances past the end of slots
+	max   int               // highest seq ever decided here, -1 if none
+}
+
+func newInstanceStore() *instanceStore {
+	return &instanceStore{max: -1, far: make(map[int]*instance)}
+}
+
+//
+// the state for seq, or nil if there is none (or it is forgotten).
+//
+func (is *instanceStore) get(seq int) *instance {
+	if seq < is.base {
+		return nil
+	}
+	if seq-is.base >= len(is.slots) {
+		return is.far[seq]
+	}
+	return is.slots[seq-is.base]
+}
+
+//
+// the state for seq, created if need be. nil if seq is forgotten.
+//
+func (is *instanceStore) at(seq int) *instance {
+	if seq < is.base {
+		return nil
+	}
+	if seq-is.base >= len(is.slots) {
+		if inst := is.far[seq]; inst != nil {
+			return inst
+		}
+		if seq-is.base-len(is.slots) >= maxDense {
+			inst := &instance{}
+			is.far[seq] = inst
+			return inst
+		}
+		is.grow(seq)
+	}
+	if is.slots[seq-is.base] == nil {
+		is.slots[seq-is.base] = &instance{}
+	}
+	return is.slots[seq-is.base]
+}
+
+//
+// extend the slice through seq, moving in the instances from
+// the map that it now covers.
+//
+func (is *instanceStore) grow(seq int) {
+	for seq-is.base >= len(is.slots) {
+		is.slots = append(is.slots, nil)
+	}
+	for s, inst := range is.far {
+		if s-is.base < len(is.slots) {
+			delete(is.far, s)
+			is.slots[s-is.base] = inst
+		}
+	}
+}
+
+func (is *instanceStore) decided(seq int) (interface{}, bool) {
+	if inst := is.get(seq); inst != nil && inst.decided {
+		return inst.v, true
+	}
+	return nil, false
+}
+
+func (is *instanceStore) decide(seq int, v interface{}) {
+	if inst := is.at(seq); inst != nil {
+		inst.decided = true
+		inst.v = v
+		if seq > is.max {
+			is.max = seq
+		}
+	}
+}
+
+func (is *instanceStore) promise(seq int) (ProposalNumber, bool) {
+	if inst := is.get(seq); inst != nil && inst.hasNp {
+		return inst.np, true
+	}
+	return ProposalNumber{}, false
+}
+
+func (is *instanceStore) setPromise(seq int, n ProposalNumber) {
+	if inst := is.at(seq); inst != nil {
+		inst.hasNp = true
+		inst.np = n
+	}
+}
+
+func (is *instanceStore) accepted(seq int) (ProposalNumber, interface{}, bool) {
+	if inst := is.get(seq); inst != nil && inst.hasNa {
+		return inst.na, inst.va, true
+	}
+	return ProposalNumber{}, nil, false
+}
+
+//
+// accept (n, v) for seq, which also promises n.
+//
+func (is *instanceStore) accept(seq int, n ProposalNumber, v interface{}) {
+	if inst := is.at(seq); inst != nil {
+		inst.hasNp = true
+		inst.np = n
+		inst.hasNa = true
+		inst.na = n
+		inst.va = v
+	}
+}
+
+func (is *instanceStore) isForgotten(seq int) bool {
+	return seq < is.base
+}
+
+//
+// forget every instance < seq.
+//
+func (is *instanceStore) forget(seq int) {
+	if seq <= is.base {
+		return
+	}
+	n := seq - is.base
+	if n > len(is.slots) {
+		n = len(is.slots)
+	}
+	for i := 0; i < n; i++ {
+		is.slots[i] = nil // let the values be collected
+	}
+	is.slots = is.slots[n:]
+	is.base = seq
+	for s := range is.far {
+		if s < is.base {
+			delete(is.far, s)
+		}
+	}
+}
+
+//
+// call f for every instance >= from that has some state, in order.
+//
+func (is *instanceStore) each(from int, f func(seq int, inst *instance)) {
+	if from < is.base {
+		from = is.base
+	}
+	for seq := from; seq-is.base < len(is.slots); seq++ {
+		if inst := is.slots[seq-is.base]; inst != nil {
+			f(seq, inst)
+		}
+	}
+	var far []int
+	for seq := range is.far {
+		if seq >= from {
+			far = append(far, seq)
+		}
+	}
+	sort.Ints(far)
+	for _, seq := range far {
+		f(seq, is.far[seq])
+	}
+}
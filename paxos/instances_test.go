@@ -0,0 +1,112 @@
+package paxos
+
+import (
+	"fmt"
+	"net/rpc"
+	"os"
+	"strconv"
+	"testing"
+)
+
+//
+// Status(), Max() and Done()+Forget() should cost the same
+// whether the log holds a thousand instances or a million.
+//
+
+var logSizes = []int{1000, 10000, 100000, 1000000}
+
+func benchPaxos(b *testing.B, size int) *Paxos {
+	port := "/var/tmp/824-bench-" + strconv.Itoa(os.Getpid())
+	px := Make([]string{port}, 0, rpc.NewServer())
+	for seq := 0; seq < size; seq++ {
+		px.LocalLearn(seq, seq)
+	}
+	b.ResetTimer()
+	return px
+}
+
+func BenchmarkStatus(b *testing.B) {
+	for _, size := range logSizes {
+		b.Run(fmt.Sprintf("log=%d", size), func(b *testing.B) {
+			px := benchPaxos(b, size)
+			defer px.Kill()
+			for i := 0; i < b.N; i++ {
+				px.Status(i % size)
+			}
+		})
+	}
+}
+
+func BenchmarkMax(b *testing.B) {
+	for _, size := range logSizes {
+		b.Run(fmt.Sprintf("log=%d", size), func(b *testing.B) {
+			px := benchPaxos(b, size)
+			defer px.Kill()
+			for i := 0; i < b.N; i++ {
+				px.Max()
+			}
+		})
+	}
+}
+
+//
+// decide one more instance and forget the oldest one, so
+// that the log keeps its size.
+//
+func BenchmarkForget(b *testing.B) {
+	for _, size := range logSizes {
+		b.Run(fmt.Sprintf("log=%d", size), func(b *testing.B) {
+			px := benchPaxos(b, size)
+			defer px.Kill()
+			for i := 0; i < b.N; i++ {
+				px.LocalLearn(size+i, size+i)
+				px.Done(i)
+			}
+		})
+	}
+}
+
+func TestInstanceStoreFarOff(t *testing.T) {
+	is := newInstanceStore()
+	is.decide(0, "a")
+	far := 1 << 40
+	is.decide(far, "far")
+	is.setPromise(maxDense+5, ProposalNumber{1, "x"})
+	if len(is.slots) > 1 {
+		t.Fatalf("a far off seq grew the slice to %v slots", len(is.slots))
+	}
+	if v, ok := is.decided(far); !ok || v != "far" {
+		t.Fatalf("decided(%v) got %v %v", far, v, ok)
+	}
+	if is.max != far {
+		t.Fatalf("max is %v, wanted %v", is.max, far)
+	}
+
+	// a log that grows in order stays in the slice, and takes
+	// in the far off instances it reaches.
+	is.forget(10)
+	for seq := 10; seq <= maxDense+6; seq++ {
+		is.decide(seq, seq)
+	}
+	if len(is.far) != 1 {
+		t.Fatalf("%v far instances once the slice grew past maxDense, wanted 1", len(is.far))
+	}
+	if np, ok := is.promise(maxDense + 5); !ok || np != (ProposalNumber{1, "x"}) {
+		t.Fatalf("promise(%v) got %v %v", maxDense+5, np, ok)
+	}
+	var seqs []int
+	is.each(maxDense+4, func(seq int, inst *instance) {
+		seqs = append(seqs, seq)
+	})
+	if len(seqs) != 4 || seqs[1] != maxDense+5 || seqs[3] != far {
+		t.Fatalf("each() visited %v", seqs)
+	}
+
+	is.forget(far + 1)
+	if len(is.far) != 0 || len(is.slots) != 0 {
+		t.Fatalf("forget(%v) kept %v slots, %v far", far+1, len(is.slots), len(is.far))
+	}
+	if !is.isForgotten(far) {
+		t.Fatalf("%v is not forgotten", far)
+	}
+}
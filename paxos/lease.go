@@ -0,0 +1,244 @@
+package paxos
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+//
+// leader leases (see WithLeases).
+//
+// a peer holds the lease once a majority of acceptors have
+// granted it one. for LeaseDuration after granting, measured
+// on its own clock from when the request arrived, an acceptor
+// rejects Prepare and Accept from every other proposer, and
+// tells them who the holder is, so that they forward their
+// values to it instead. so while the lease lasts, only the
+// holder gets values decided, and every value decided before
+// the lease is at an instance no higher than some granting
+// acceptor's Max(). once the holder knows all of those (see
+// HoldsLease), its state is as fresh as anyone's and it can
+// answer reads locally.
+//
+// the holder counts its lease from before it sent the request,
+// and shortens it by ClockDrift and LeaseMargin, so that it
+// gives the lease up before any acceptor does even if their
+// clocks run at slightly different rates. the holder renews
+// every LeaseRenew.
+//
+// a peer with a write-ahead log (WithStorage) that restarts
+// does not know whom it granted a lease to, so it grants and
+// accepts nothing for LeaseDuration. leases assume that the
+// membership does not change (see WithReconfig).
+//
+
+const (
+	LeaseDuration = 500 * time.Millisecond
+	LeaseRenew    = LeaseDuration / 5
+	ClockDrift    = 0.01 // the most two clocks' rates may differ by
+	LeaseMargin   = 10 * time.Millisecond
+)
+
+// grantedTo after a restart: a lease may be out, to anyone.
+const leaseUnknown = "?"
+
+type LeaseArgs struct {
+	From string // the requester's port
+}
+
+type LeaseReply struct {
+	Granted  bool
+	LeasedTo string // the holder's port, if not granted
+	Max      int    // the highest instance the acceptor knows of
+}
+
+func (px *Paxos) Lease(args *LeaseArgs, reply *LeaseReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if px.leaseBlocks(args.From) {
+		reply.LeasedTo = px.leasedTo()
+		return nil
+	}
+	px.impl.grantedTo = args.From
+	px.impl.grantExpiry = time.Now().Add(LeaseDuration)
+	reply.Granted = true
+	reply.Max = px.impl.instances.max
+	if px.impl.maxKnown > reply.Max {
+		reply.Max = px.impl.maxKnown
+	}
+	return nil
+}
+
+//
+// has this peer, as an acceptor, leased itself to someone other
+// than the proposer on port id? caller holds px.mu.
+//
+func (px *Paxos) leaseBlocks(id string) bool {
+	if !px.impl.leases || px.impl.grantedTo == NoLeader || px.impl.grantedTo == id {
+		return false
+	}
+	return time.Now().Before(px.impl.grantExpiry)
+}
+
+//
+// the port of the peer this acceptor is leased to, "" if none
+// or unknown. caller holds px.mu.
+//
+func (px *Paxos) leasedTo() string {
+	g := px.impl.grantedTo
+	if g == leaseUnknown || !time.Now().Before(px.impl.grantExpiry) {
+		return ""
+	}
+	return g
+}
+
+//
+// an acceptor turned us down for holder's lease.
+//
+func (px *Paxos) noteHolder(holder string) {
+	if holder == "" {
+		return
+	}
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	px.impl.leaseHint = holder
+}
+
+//
+// does this peer hold the lease? caller holds px.mu.
+//
+func (px *Paxos) leaseValid() bool {
+	return px.impl.leases && time.Now().Before(px.impl.leaseExpiry)
+}
+
+func (px *Paxos) leaseLoop() {
+	for !px.isdead() {
+		time.Sleep(LeaseRenew)
+		px.mu.Lock()
+		holding := px.leaseValid()
+		px.mu.Unlock()
+		if !holding {
+			// don't all ask at once.
+			time.Sleep(time.Duration(rand.Int63n(int64(LeaseRenew))))
+		}
+		px.acquireLease()
+	}
+}
+
+//
+// ask a majority for the lease, or to extend it, unless this
+// peer knows that another one holds it.
+//
+func (px *Paxos) acquireLease() {
+	px.mu.Lock()
+	if px.leaseBlocks(px.impl.addr) {
+		px.mu.Unlock()
+		return
+	}
+	seq := px.impl.instances.max + 1
+	px.mu.Unlock()
+	peers, members, majority := px.quorum(seq)
+	isMember := false
+	for _, idx := range members {
+		isMember = isMember || idx == px.me
+	}
+	if !isMember {
+		return
+	}
+
+	start := time.Now()
+	args := &LeaseArgs{From: px.impl.addr}
+	replies := make(chan LeaseReply, len(members))
+	granted := px.fanOut(members, majority, func(idx int) bool {
+		var reply LeaseReply
+		ok := px.call(peers[idx], "Paxos.Lease", args, &reply)
+		if ok {
+			replies <- reply
+		}
+		return ok && reply.Granted
+	})
+	through := -1
+	for n := len(replies); n > 0; n-- {
+		reply := <-replies
+		if reply.Granted && reply.Max > through {
+			through = reply.Max
+		} else if !reply.Granted {
+			px.noteHolder(reply.LeasedTo)
+		}
+	}
+	if !granted {
+		return
+	}
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	lasts := time.Duration(float64(LeaseDuration)*(1-ClockDrift)) - LeaseMargin
+	px.impl.leaseExpiry = start.Add(lasts)
+	if through > px.impl.leaseThrough {
+		px.impl.leaseThrough = through
+	}
+	px.impl.leaseHint = px.peers[px.me]
+}
+
+//
+// does this peer hold the lease? if so, a read served locally
+// must first see every instance <= through decided and applied.
+// false if leases are off (see WithLeases).
+//
+func (px *Paxos) HoldsLease() (int, bool) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if !px.leaseValid() {
+		return -1, false
+	}
+	through := px.impl.leaseThrough
+	if px.impl.instances.max > through {
+		through = px.impl.instances.max
+	}
+	return through, true
+}
+
+//
+// the port of the peer this one believes holds the lease, ""
+// if it has no idea. only HoldsLease() is authoritative.
+//
+func (px *Paxos) LeaseHolder() string {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if px.leaseValid() {
+		return px.peers[px.me]
+	}
+	if holder := px.leasedTo(); holder != "" {
+		return holder
+	}
+	return px.impl.leaseHint
+}
+
+//
+// if another peer holds the lease, have it propose v for seq
+// rather than fight it. returns true if seq got decided (or
+// ctx was cancelled) meanwhile.
+//
+func (px *Paxos) forwardToHolder(ctx context.Context, seq int, v interface{}) bool {
+	px.mu.Lock()
+	holder := px.impl.leaseHint
+	if px.leaseValid() || holder == px.peers[px.me] {
+		holder = ""
+	}
+	if h := px.leasedTo(); h != "" && h != px.peers[px.me] {
+		holder = h
+	}
+	px.mu.Unlock()
+	if holder == "" {
+		return false
+	}
+	if px.forward(ctx, seq, v, holder) {
+		return true
+	}
+	px.mu.Lock()
+	if px.impl.leaseHint == holder {
+		px.impl.leaseHint = ""
+	}
+	px.mu.Unlock()
+	return false
+}
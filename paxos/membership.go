@@ -0,0 +1,311 @@
+package paxos
+
+import (
+	"context"
+	"encoding/gob"
+	"sort"
+	"time"
+
+	"umich.edu/eecs491/proj5/common"
+)
+
+//
+// dynamic membership (see WithReconfig).
+//
+// membership is changed by agreeing on a Reconfig value like
+// any other value. a Reconfig decided for instance s takes
+// effect Alpha instances later: every instance >= s+Alpha uses
+// the new member set for its majorities, and a proposer for
+// instance t first waits until it knows every decision <= t-Alpha,
+// so that it cannot miss a change that applies to t.
+//
+// px.peers lists every peer that was ever a member: the peers
+// given to Make(), then the added ones in log order. a joiner
+// starts from a different list, so indexes are only meaningful
+// locally; messages name peers by port (see ProposalNumber).
+//
+// a peer started with WithJoin() hears about decisions from its
+// own AddPeer on; until it knows the instances before that, its
+// proposers wait in waitForWindow().
+//
+
+const Alpha = 8
+
+const (
+	AddPeerOp    = "AddPeer"
+	RemovePeerOp = "RemovePeer"
+)
+
+type Reconfig struct {
+	Op   string // AddPeerOp or RemovePeerOp
+	Peer string
+}
+
+func init() {
+	gob.Register(Reconfig{})
+}
+
+func AddPeer(peer string) Reconfig {
+	return Reconfig{Op: AddPeerOp, Peer: peer}
+}
+
+func RemovePeer(peer string) Reconfig {
+	return Reconfig{Op: RemovePeerOp, Peer: peer}
+}
+
+//
+// the members (indexes into px.peers) for instances >= From.
+//
+type epoch struct {
+	From    int
+	Members []int
+}
+
+//
+// recompute px.peers, the epochs and peersDone from the
+// Reconfig values decided so far. caller holds px.mu.
+//
+func (px *Paxos) rebuildMembership() {
+	peers := make([]string, len(px.impl.initialPeers))
+	copy(peers, px.impl.initialPeers)
+	index := make(map[string]int)
+	active := make(map[int]bool)
+	for idx, peer := range peers {
+		index[peer] = idx
+		if !(px.impl.joining && idx == px.me) && !px.impl.learnerPorts[peer] {
+			active[idx] = true
+		}
+	}
+	epochs := []epoch{{From: 0, Members: sortedMembers(active)}}
+
+	var seqs []int
+	for seq := range px.impl.reconfigs {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	for _, seq := range seqs {
+		rc := px.impl.reconfigs[seq]
+		idx, known := index[rc.Peer]
+		if rc.Op == AddPeerOp {
+			if !known {
+				idx = len(peers)
+				peers = append(peers, rc.Peer)
+				index[rc.Peer] = idx
+				if px.impl.key != nil {
+					common.SetKey(rc.Peer, px.impl.key)
+				}
+			}
+			active[idx] = true
+		} else if rc.Op == RemovePeerOp && known {
+			delete(active, idx)
+		}
+		epochs = append(epochs, epoch{From: seq + Alpha, Members: sortedMembers(active)})
+	}
+
+	peersDone := make([]int, len(peers))
+	for idx := range peersDone {
+		peersDone[idx] = InitDone
+	}
+	for old, peer := range px.peers {
+		peersDone[index[peer]] = px.impl.peersDone[old]
+	}
+	// a learner that an AddPeer made a member votes from then on.
+	learners := make(map[int]bool)
+	for peer := range px.impl.learnerPorts {
+		if idx, known := index[peer]; known && !active[idx] {
+			learners[idx] = true
+		}
+	}
+	// px.me never moves: this peer is in the prefix given to Make().
+	px.peers = peers
+	px.impl.peersDone = peersDone
+	px.impl.epochs = epochs
+	px.impl.learners = sortedMembers(learners)
+}
+
+func sortedMembers(active map[int]bool) []int {
+	var members []int
+	for idx := range active {
+		members = append(members, idx)
+	}
+	sort.Ints(members)
+	return members
+}
+
+//
+// note a decided value: wake up Notify() callers and, if it is
+// a Reconfig, update the membership. caller holds px.mu.
+//
+func (px *Paxos) noteDecided(seq int, v interface{}) {
+	px.noteSeq(seq)
+	px.notifyDecided(seq, v)
+	px.advanceDecided(InitDone)
+	if rc, isReconfig := v.(Reconfig); isReconfig && px.impl.reconfigurable {
+		if _, known := px.impl.reconfigs[seq]; !known {
+			px.impl.reconfigs[seq] = rc
+			px.rebuildMembership()
+		}
+	}
+}
+
+//
+// everything <= through is known to be decided; move
+// decidedThrough up as far as the log allows. caller holds px.mu.
+//
+func (px *Paxos) advanceDecided(through int) {
+	if through > px.impl.decidedThrough {
+		px.impl.decidedThrough = through
+	}
+	for {
+		if _, ok := px.impl.instances.decided(px.impl.decidedThrough + 1); !ok {
+			break
+		}
+		px.impl.decidedThrough += 1
+	}
+}
+
+//
+// members for instance seq. caller holds px.mu.
+//
+func (px *Paxos) membersAt(seq int) []int {
+	members := px.impl.epochs[0].Members
+	for _, e := range px.impl.epochs {
+		if e.From <= seq {
+			members = e.Members
+		}
+	}
+	return members
+}
+
+//
+// the first instance of the epoch seq falls in. caller holds px.mu.
+//
+func (px *Paxos) epochStart(seq int) int {
+	start := 0
+	for _, e := range px.impl.epochs {
+		if e.From <= seq {
+			start = e.From
+		}
+	}
+	return start
+}
+
+//
+// the targets and majority for an instance, plus a copy of
+// px.peers to look the targets up in.
+//
+func (px *Paxos) quorum(seq int) ([]string, []int, int) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	peers := make([]string, len(px.peers))
+	copy(peers, px.peers)
+	members := px.membersAt(seq)
+	return peers, members, len(members)/2 + 1
+}
+
+//
+// peers that should hear about a decision for seq: the members
+// at seq, the latest members, who may have joined since, and
+// the learners. the Learn fan-out only waits for as many of
+// them as the members make up a majority of (need).
+//
+func (px *Paxos) learners(seq int) ([]string, []int, int) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	peers := make([]string, len(px.peers))
+	copy(peers, px.peers)
+	targets := make(map[int]bool)
+	for _, idx := range px.membersAt(seq) {
+		targets[idx] = true
+	}
+	for _, idx := range px.impl.epochs[len(px.impl.epochs)-1].Members {
+		targets[idx] = true
+	}
+	targets[px.me] = true
+	need := len(targets)/2 + 1
+	for _, idx := range px.impl.learners {
+		targets[idx] = true
+	}
+	return peers, sortedMembers(targets), need
+}
+
+//
+// with reconfiguration on, block until every instance <= seq-Alpha
+// is known here, so that membersAt(seq) is final. returns false
+// if ctx is done (or the peer killed) first.
+//
+func (px *Paxos) waitForWindow(ctx context.Context, seq int) bool {
+	if !px.impl.reconfigurable {
+		return true
+	}
+	for !px.isdead() {
+		px.mu.Lock()
+		known := px.impl.decidedThrough >= seq-Alpha
+		px.mu.Unlock()
+		if known {
+			return true
+		}
+		if !sleepContext(ctx, 10*time.Millisecond) {
+			return false
+		}
+	}
+	return false
+}
+
+//
+// the current members' ports.
+//
+func (px *Paxos) Members() []string {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	var members []string
+	for _, idx := range px.impl.epochs[len(px.impl.epochs)-1].Members {
+		members = append(members, px.peers[idx])
+	}
+	return members
+}
+
+//
+// this peer's port.
+//
+func (px *Paxos) self() string {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return px.peers[px.me]
+}
+
+//
+// this peer's port, as given to Make().
+//
+func (px *Paxos) Port() string {
+	return px.impl.addr
+}
+
+//
+// the current members and learners: everyone that hears about
+// decisions and whose Done() value Min() waits for. caller
+// holds px.mu.
+//
+func (px *Paxos) followers() []int {
+	all := make(map[int]bool)
+	for _, idx := range px.impl.epochs[len(px.impl.epochs)-1].Members {
+		all[idx] = true
+	}
+	for _, idx := range px.impl.learners {
+		all[idx] = true
+	}
+	return sortedMembers(all)
+}
+
+//
+// the learners' ports (see WithLearners).
+//
+func (px *Paxos) Learners() []string {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	var learners []string
+	for _, idx := range px.impl.learners {
+		learners = append(learners, px.peers[idx])
+	}
+	return learners
+}
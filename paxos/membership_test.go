@@ -0,0 +1,171 @@
+package paxos
+
+import (
+	"net/rpc"
+	"testing"
+	"time"
+
+	"umich.edu/eecs491/proj5/common"
+)
+
+//
+// check that every live peer has members as the current membership.
+//
+func checkMembers(t *testing.T, pxa []*Paxos, members []string) {
+	for _, px := range pxa {
+		if px == nil {
+			continue
+		}
+		got := px.Members()
+		if len(got) != len(members) {
+			t.Fatalf("%v: members %v, wanted %v", px.Port(), got, members)
+		}
+		want := make(map[string]bool)
+		for _, m := range members {
+			want[m] = true
+		}
+		for _, m := range got {
+			if !want[m] {
+				t.Fatalf("%v: members %v, wanted %v", px.Port(), got, members)
+			}
+		}
+	}
+}
+
+//
+// decide a value for each of seqs [from, to), proposed by every
+// live peer at once, and wait for wanted peers to decide it.
+//
+func decideRange(t *testing.T, pxa []*Paxos, from int, to int, wanted int) {
+	for seq := from; seq < to; seq++ {
+		for i, px := range pxa {
+			if px != nil {
+				px.Start(seq, seq*100+i)
+			}
+		}
+	}
+	for seq := from; seq < to; seq++ {
+		waitn(t, pxa, seq, wanted)
+	}
+}
+
+func TestReconfig(t *testing.T) {
+	pxa, pxh := makePeers("reconfig", 3, func(i int) []Option {
+		return []Option{WithReconfig()}
+	})
+	defer cleanup(pxa)
+	decideRange(t, pxa, 0, 5, 3)
+
+	// add a fourth peer.
+	pxh = append(pxh, port("reconfig", 3))
+	pxa = append(pxa, Make(pxh, 3, nil, WithJoin()))
+	pxa[0].Start(5, AddPeer(pxh[3]))
+	waitn(t, pxa[:3], 5, 3)
+	decideRange(t, pxa, 6, 6+Alpha, 4)
+	checkMembers(t, pxa, pxh)
+
+	// remove the third, and kill it.
+	seq := 6 + Alpha
+	pxa[1].Start(seq, RemovePeer(pxh[2]))
+	waitn(t, pxa, seq, 4)
+	pxa[2].Kill()
+	pxa[2] = nil
+	decideRange(t, pxa, seq+1, seq+1+Alpha, 3)
+	checkMembers(t, pxa, []string{pxh[0], pxh[1], pxh[3]})
+
+	// a replacement joins with the current members' list, so
+	// that its index for itself (3) is not the one the others
+	// have for it (4), but a live member's (pxh[3]'s).
+	seq += 1 + Alpha
+	replacement := port("reconfig", 4)
+	peers := []string{pxh[0], pxh[1], pxh[3], replacement}
+	pxa = append(pxa, Make(peers, 3, nil, WithJoin()))
+	pxa[3].Start(seq, AddPeer(replacement))
+	waitn(t, pxa, seq, 3)
+	decideRange(t, pxa, seq+1, seq+1+Alpha, 4)
+	checkMembers(t, pxa, peers)
+
+	// with one more peer dead, the replacement's votes are
+	// needed, and it proposes against the others.
+	pxa[0].Kill()
+	pxa[0] = nil
+	seq += 1 + Alpha
+	decideRange(t, pxa, seq, seq+10, 3)
+}
+
+func TestLearner(t *testing.T) {
+	const npaxos = 4
+	pxa, pxh := makePeers("learner", npaxos, func(i int) []Option {
+		return []Option{WithLearners(port("learner", 3))}
+	})
+	defer cleanup(pxa)
+	learner := pxa[3]
+	if ls := learner.Learners(); len(ls) != 1 || ls[0] != pxh[3] {
+		t.Fatalf("learners %v, wanted [%v]", ls, pxh[3])
+	}
+	checkMembers(t, pxa, pxh[:3])
+
+	// the learner hears every decision, its own proposals'
+	// included, but is never asked to vote.
+	for seq := 0; seq < 5; seq++ {
+		pxa[seq%npaxos].Start(seq, seq*10)
+		waitn(t, pxa, seq, npaxos)
+	}
+	learner.mu.Lock()
+	learner.impl.instances.each(0, func(seq int, inst *instance) {
+		if inst.hasNp || inst.hasNa {
+			t.Errorf("learner voted in seq %v: np %v na %v", seq, inst.np, inst.na)
+		}
+	})
+	learner.mu.Unlock()
+
+	// it does not count toward a majority either.
+	pxa[1].Kill()
+	pxa[1] = nil
+	pxa[2].Kill()
+	pxa[2] = nil
+	pxa[0].Start(5, 50)
+	learner.Start(5, 51)
+	time.Sleep(1 * time.Second)
+	if n := ndecided(t, pxa, 5); n != 0 {
+		t.Fatalf("one member and a learner decided seq 5 on %v peers", n)
+	}
+}
+
+func TestReconfigKey(t *testing.T) {
+	key := []byte("group key")
+	pxa, pxh := makePeers("reconfigkey", 3, func(i int) []Option {
+		return []Option{WithReconfig(), WithKey(key)}
+	})
+	defer cleanup(pxa)
+	defer func() {
+		for _, peer := range pxh {
+			common.SetKey(peer, nil)
+		}
+	}()
+	decideRange(t, pxa, 0, 3, 3)
+
+	// the joiner keys itself, but the members, as if in other
+	// processes, only know it from the AddPeer.
+	pxh = append(pxh, port("reconfigkey", 3))
+	pxa = append(pxa, Make(pxh, 3, nil, WithJoin(), WithKey(key)))
+	common.SetKey(pxh[3], nil)
+	pxa[0].Start(3, AddPeer(pxh[3]))
+	waitn(t, pxa[:3], 3, 3)
+	decideRange(t, pxa, 4, 4+Alpha, 4)
+
+	// so the joiner now rejects what is not sealed with the key.
+	c, err := rpc.Dial(common.Network(pxh[3]), pxh[3])
+	if err != nil {
+		t.Fatalf("dial %v: %v", pxh[3], err)
+	}
+	defer c.Close()
+	var reply DecidedReply
+	args := &DecidedArgs{Seq: 4 + Alpha, V: "forged"}
+	if err := c.Call("Paxos.Learn", args, &reply); err == nil {
+		t.Fatalf("an unauthenticated Learn went through")
+	}
+	if fate, _ := pxa[3].Status(4 + Alpha); fate == Decided {
+		t.Fatalf("the joiner learned a forged value")
+	}
+}
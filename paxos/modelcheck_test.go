@@ -0,0 +1,418 @@
+package paxos
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/rpc"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//
+// an explicit-state model checker for the acceptor side of Paxos.
+//
+// three peers run the real Prepare, Accept and Learn handlers
+// (and LocalAccept, for a proposer's own peer) on instance 0.
+// two proposers, on peers 0 and 1, are modelled as message-driven
+// state machines, allowed mcBallots[p] ballots numbered 0, 1, ...,
+// so that both use Number 0 with different Ids.
+// a breadth-first search delivers the Prepare and Accept requests
+// in flight in every order, restoring the peers' state before each
+// step, and checks every reachable state for agreement (no two
+// different values decided or chosen) and validity (only proposed
+// values decided). since the search is breadth-first, the trace it
+// prints for a violation is a shortest one.
+//
+// to keep the state space small, a request's reply reaches the
+// proposer right after the handler runs, or is lost (a request
+// that is never delivered is lost too), and a value's Learns all
+// go out at once when a proposer sees it chosen.
+//
+
+const (
+	mcPeers     = 3
+	mcProposers = 2
+	mcMajority  = mcPeers/2 + 1
+)
+
+var mcBallots = [mcProposers]int{2, 1}
+
+var mcValues = []string{"A", "B"}
+
+const (
+	mcPrepare = iota
+	mcAccept
+)
+
+//
+// a request in flight from a proposer to a peer.
+//
+type mcMessage struct {
+	Kind int
+	From int // proposer
+	To   int // peer
+	N    ProposalNumber
+	V    string
+}
+
+func (m mcMessage) String() string {
+	if m.Kind == mcPrepare {
+		return fmt.Sprintf("prepare(%v.%v) p%v->a%v", m.N.Number, m.N.Id, m.From, m.To)
+	}
+	return fmt.Sprintf("accept(%v.%v %q) p%v->a%v", m.N.Number, m.N.Id, m.V, m.From, m.To)
+}
+
+//
+// what a handler answered.
+//
+type mcReply struct {
+	Response Response
+	Na       ProposalNumber
+	Va       string
+}
+
+func (r mcReply) String() string {
+	if r.Response == OK && r.Va != "" {
+		return fmt.Sprintf("%v na=%v.%v va=%q", r.Response, r.Na.Number, r.Na.Id, r.Va)
+	}
+	return string(r.Response)
+}
+
+const (
+	mcIdle = iota
+	mcPreparing
+	mcAccepting
+	mcDone
+)
+
+type mcProposer struct {
+	Phase   int
+	Ballots int // ballots started so far
+	N       ProposalNumber
+	Acks    int
+	HasBest bool
+	BestNa  ProposalNumber
+	BestVa  string
+	V       string // value being accepted
+}
+
+type mcState struct {
+	acceptors [mcPeers]instance
+	proposers [mcProposers]mcProposer
+	inFlight  []mcMessage
+	chosen    string // value a proposer saw accepted by a majority
+}
+
+func (s *mcState) key() string {
+	var b strings.Builder
+	n := func(n ProposalNumber) {
+		b.WriteString(strconv.Itoa(n.Number))
+		b.WriteByte('.')
+		b.WriteString(n.Id)
+		b.WriteByte(' ')
+	}
+	flag := func(f bool) {
+		if f {
+			b.WriteString("+ ")
+		} else {
+			b.WriteString("- ")
+		}
+	}
+	for _, a := range s.acceptors {
+		flag(a.hasNp)
+		n(a.np)
+		flag(a.hasNa)
+		n(a.na)
+		b.WriteString(valueString(a.va))
+		flag(a.decided)
+		b.WriteString(valueString(a.v))
+		b.WriteByte('|')
+	}
+	for _, p := range s.proposers {
+		b.WriteString(strconv.Itoa(p.Phase*100 + p.Ballots*10 + p.Acks))
+		n(p.N)
+		flag(p.HasBest)
+		n(p.BestNa)
+		b.WriteString(p.BestVa + " " + p.V + "|")
+	}
+	msgs := make([]string, len(s.inFlight))
+	for i, m := range s.inFlight {
+		msgs[i] = fmt.Sprint(m.Kind, m.From, m.To, m.N.Number, m.V)
+	}
+	sort.Strings(msgs)
+	b.WriteString(strings.Join(msgs, ","))
+	b.WriteString("|" + s.chosen)
+	return b.String()
+}
+
+func (s *mcState) clone() *mcState {
+	c := *s
+	c.inFlight = append([]mcMessage(nil), s.inFlight...)
+	return &c
+}
+
+type mcChecker struct {
+	pxa []*Paxos
+	// a broken proposer, to check that the checker finds bugs:
+	// ignore the values reported by prepare replies.
+	ignoreAccepted bool
+}
+
+func newChecker() *mcChecker {
+	mc := &mcChecker{}
+	var peers []string
+	for i := 0; i < mcPeers; i++ {
+		peers = append(peers, "/var/tmp/824-mc-"+strconv.Itoa(os.Getpid())+"-"+strconv.Itoa(i))
+	}
+	for i := 0; i < mcPeers; i++ {
+		mc.pxa = append(mc.pxa, Make(peers, i, rpc.NewServer()))
+	}
+	return mc
+}
+
+func (mc *mcChecker) kill() {
+	for _, px := range mc.pxa {
+		px.Kill()
+	}
+}
+
+//
+// put the peers' instance 0 back the way s has it.
+//
+func (mc *mcChecker) restore(s *mcState) {
+	for i, px := range mc.pxa {
+		px.mu.Lock()
+		inst := s.acceptors[i]
+		px.impl.instances = newInstanceStore()
+		px.impl.instances.slots = []*instance{&inst}
+		px.mu.Unlock()
+	}
+}
+
+func (mc *mcChecker) save(s *mcState) {
+	for i, px := range mc.pxa {
+		px.mu.Lock()
+		if inst := px.impl.instances.get(0); inst != nil {
+			s.acceptors[i] = *inst
+		}
+		px.mu.Unlock()
+	}
+}
+
+func valueString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return v.(string)
+}
+
+//
+// the states that follow s, each with a label for the trace.
+//
+func (mc *mcChecker) next(s *mcState) ([]*mcState, []string) {
+	var succs []*mcState
+	var labels []string
+
+	// a proposer times out and starts its next ballot.
+	for p := 0; p < mcProposers; p++ {
+		pr := s.proposers[p]
+		if pr.Phase == mcDone || pr.Ballots >= mcBallots[p] {
+			continue
+		}
+		c := s.clone()
+		c.proposers[p] = mcProposer{
+			Phase:   mcPreparing,
+			Ballots: pr.Ballots + 1,
+			N:       ProposalNumber{Number: pr.Ballots, Id: strconv.Itoa(p)},
+		}
+		for a := 0; a < mcPeers; a++ {
+			c.inFlight = append(c.inFlight, mcMessage{Kind: mcPrepare, From: p, To: a, N: c.proposers[p].N})
+		}
+		succs = append(succs, c)
+		labels = append(labels, fmt.Sprintf("p%v starts ballot %v.%v", p, pr.Ballots, p))
+	}
+
+	// deliver any one request, and its reply or not.
+	for i, m := range s.inFlight {
+		for _, replied := range []bool{true, false} {
+			c := s.clone()
+			c.inFlight = append(c.inFlight[:i:i], c.inFlight[i+1:]...)
+			mc.restore(c)
+			r := mc.deliver(m)
+			if replied {
+				mc.reply(c, m, r)
+			}
+			mc.save(c)
+			succs = append(succs, c)
+			if replied {
+				labels = append(labels, fmt.Sprintf("%v: %v", m, r))
+			} else {
+				labels = append(labels, fmt.Sprintf("%v: reply lost", m))
+			}
+		}
+	}
+	return succs, labels
+}
+
+//
+// run the handler for m on its peer.
+//
+func (mc *mcChecker) deliver(m mcMessage) mcReply {
+	if m.Kind == mcPrepare {
+		args := &PrepareArgs{Seq: 0, N: m.N, Done: InitDone}
+		reply := &PrepareReply{}
+		mc.pxa[m.To].Prepare(args, reply)
+		return mcReply{reply.Response, reply.Na, valueString(reply.Va)}
+	}
+	if m.To == m.From {
+		// a proposer accepts on its own peer without an RPC.
+		if mc.pxa[m.To].LocalAccept(0, m.V, m.N) {
+			return mcReply{Response: OK}
+		}
+		return mcReply{Response: Reject}
+	}
+	args := &AcceptArgs{Seq: 0, N: m.N, V: m.V, Done: InitDone}
+	reply := &AcceptReply{}
+	mc.pxa[m.To].Accept(args, reply)
+	return mcReply{Response: reply.Response}
+}
+
+//
+// the proposer that sent m hears the reply r.
+//
+func (mc *mcChecker) reply(s *mcState, m mcMessage, r mcReply) {
+	pr := &s.proposers[m.From]
+	if m.Kind == mcPrepare {
+		if pr.Phase != mcPreparing || pr.N != m.N || r.Response == Reject {
+			return
+		}
+		pr.Acks += 1
+		if r.Response == OK && !mc.ignoreAccepted && (!pr.HasBest || r.Na.Number > pr.BestNa.Number) {
+			pr.HasBest = true
+			pr.BestNa = r.Na
+			pr.BestVa = r.Va
+		}
+		if pr.Acks == mcMajority {
+			pr.Phase = mcAccepting
+			pr.Acks = 0
+			pr.V = mcValues[m.From]
+			if pr.HasBest {
+				pr.V = pr.BestVa
+			}
+			for a := 0; a < mcPeers; a++ {
+				s.inFlight = append(s.inFlight, mcMessage{Kind: mcAccept, From: m.From, To: a, N: pr.N, V: pr.V})
+			}
+		}
+		return
+	}
+	if pr.Phase != mcAccepting || pr.N != m.N || r.Response != OK {
+		return
+	}
+	pr.Acks += 1
+	if pr.Acks == mcMajority {
+		pr.Phase = mcDone
+		if s.chosen == "" {
+			s.chosen = pr.V
+		} else if s.chosen != pr.V {
+			// recorded as a second choice; check() reports it.
+			s.chosen += "," + pr.V
+		}
+		for a := 0; a < mcPeers; a++ {
+			mc.pxa[a].Learn(&DecidedArgs{Seq: 0, V: pr.V, N: pr.N}, &DecidedReply{})
+		}
+	}
+}
+
+//
+// agreement and validity; "" if s is fine.
+//
+func check(s *mcState) string {
+	decided := ""
+	for i, a := range s.acceptors {
+		if !a.decided {
+			continue
+		}
+		v := valueString(a.v)
+		if v != mcValues[0] && v != mcValues[1] {
+			return fmt.Sprintf("validity: a%v decided %q, which nobody proposed", i, v)
+		}
+		if decided != "" && decided != v {
+			return fmt.Sprintf("agreement: decided both %q and %q", decided, v)
+		}
+		decided = v
+	}
+	if strings.Contains(s.chosen, ",") {
+		return fmt.Sprintf("agreement: proposers saw %v each accepted by a majority", s.chosen)
+	}
+	if decided != "" && s.chosen != "" && decided != s.chosen {
+		return fmt.Sprintf("agreement: decided %q but %q was chosen", decided, s.chosen)
+	}
+	return ""
+}
+
+//
+// explore every reachable state; on a violation, return it
+// with the shortest trace that leads there.
+//
+func (mc *mcChecker) run() (int, string, []string) {
+	type node struct {
+		s      *mcState
+		parent *node
+		label  string
+	}
+	init := &mcState{}
+	seen := map[string]bool{init.key(): true}
+	queue := []*node{{s: init}}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if problem := check(n.s); problem != "" {
+			var trace []string
+			for p := n; p.parent != nil; p = p.parent {
+				trace = append([]string{p.label}, trace...)
+			}
+			return len(seen), problem, trace
+		}
+		succs, labels := mc.next(n.s)
+		for i, c := range succs {
+			if k := c.key(); !seen[k] {
+				seen[k] = true
+				queue = append(queue, &node{s: c, parent: n, label: labels[i]})
+			}
+		}
+	}
+	return len(seen), "", nil
+}
+
+func quietLog() func() {
+	// the equal-Number rejection path logs on every visit.
+	log.SetOutput(ioutil.Discard)
+	return func() { log.SetOutput(os.Stderr) }
+}
+
+func TestModelCheckHandlers(t *testing.T) {
+	defer quietLog()()
+	mc := newChecker()
+	defer mc.kill()
+	states, problem, trace := mc.run()
+	if problem != "" {
+		t.Fatalf("%v after:\n  %v", problem, strings.Join(trace, "\n  "))
+	}
+	fmt.Printf("  ... %v states checked\n", states)
+}
+
+func TestModelCheckFindsBrokenProposer(t *testing.T) {
+	defer quietLog()()
+	mc := newChecker()
+	defer mc.kill()
+	mc.ignoreAccepted = true
+	_, problem, trace := mc.run()
+	if problem == "" {
+		t.Fatalf("a proposer that ignores accepted values went unnoticed")
+	}
+	t.Logf("%v after:\n  %v", problem, strings.Join(trace, "\n  "))
+}
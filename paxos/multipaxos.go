@@ -0,0 +1,134 @@
+package paxos
+
+import (
+	"context"
+	"time"
+)
+
+//
+// Multi-Paxos (see WithMultiPaxos).
+//
+// a proposer that wins a prepare with All set holds its ballot
+// for every instance >= the prepared seq, so later instances go
+// straight to the accept phase. any Accept rejection, or a higher
+// multi-paxos prepare from another peer, ends the leadership and
+// the next proposal runs a full prepare again.
+//
+
+const (
+	ForwardTimeout = 500 * time.Millisecond // wait on the leader before proposing ourselves
+)
+
+//
+// keep, for each instance, the accepted value with the
+// highest proposal number.
+//
+func mergeAccepted(recovered map[int]AcceptedInstance, accepted []AcceptedInstance) {
+	for _, a := range accepted {
+		if prev, ok := recovered[a.Seq]; !ok || a.Na.Number > prev.Na.Number {
+			recovered[a.Seq] = a
+		}
+	}
+}
+
+//
+// our multi-paxos prepare for every instance >= seq succeeded.
+// proposals must already hold the value chosen for seq.
+//
+func (px *Paxos) lead(seq int, n ProposalNumber, proposals map[int]AcceptedInstance) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	px.impl.leading = true
+	px.impl.ballot = n
+	px.impl.leadFrom = seq
+	px.impl.leadEpoch = px.epochStart(seq)
+	px.impl.proposals = proposals
+	px.impl.leaderId = px.impl.addr
+}
+
+func (px *Paxos) isDecided(seq int) bool {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	_, isDecided := px.impl.instances.decided(seq)
+	return isDecided
+}
+
+//
+// try to get v decided for seq without a prepare phase, either
+// by accepting under our ballot as leader or by forwarding v to
+// the leader. returns false if the caller should fall back to a
+// full proposal.
+//
+func (px *Paxos) leaderPropose(ctx context.Context, seq int, v interface{}) bool {
+	px.mu.Lock()
+	if _, isDecided := px.impl.instances.decided(seq); isDecided {
+		px.mu.Unlock()
+		return true
+	}
+	// the prepare quorum only speaks for the membership it was drawn from.
+	leading := px.impl.leading && seq >= px.impl.leadFrom && px.epochStart(seq) == px.impl.leadEpoch
+	n := px.impl.ballot
+	leader := px.impl.leaderId
+	if leading {
+		if p, ok := px.impl.proposals[seq]; ok {
+			v = p.Va
+		} else {
+			// claim seq for v, so that no other value goes
+			// out under the same ballot.
+			px.impl.proposals[seq] = AcceptedInstance{Seq: seq, Na: n, Va: v}
+		}
+	}
+	px.mu.Unlock()
+
+	if leading {
+		if px.AcceptPhase(seq, v, n) {
+			px.LearnPhase(seq, v, n)
+			return true
+		}
+		px.mu.Lock()
+		if px.impl.ballot == n {
+			px.impl.leading = false
+		}
+		px.mu.Unlock()
+		return false
+	}
+
+	if leader == NoLeader || leader == px.impl.addr {
+		return false
+	}
+	if px.forward(ctx, seq, v, leader) {
+		return true
+	}
+	// the leader is gone or has stepped down.
+	px.mu.Lock()
+	if px.impl.leaderId == leader {
+		px.impl.leaderId = NoLeader
+	}
+	px.mu.Unlock()
+	return false
+}
+
+//
+// hand v to the peer at port to propose for seq, and wait up to
+// ForwardTimeout for the decision. returns true if seq got
+// decided (or ctx was cancelled) meanwhile.
+//
+func (px *Paxos) forward(ctx context.Context, seq int, v interface{}, port string) bool {
+	args := &ForwardArgs{Seq: seq, V: v, Trace: px.proposerTrace(seq)}
+	var reply ForwardReply
+	ok := px.call(port, "Paxos.Forward", args, &reply)
+	if !ok || reply.Response != OK {
+		return false
+	}
+	deadline := time.Now().Add(ForwardTimeout)
+	for time.Now().Before(deadline) && !px.isdead() {
+		if px.isDecided(seq) {
+			return true
+		}
+		if !sleepContext(ctx, 10*time.Millisecond) {
+			// cancelled: no full proposal either.
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package paxos
+
+import (
+	"testing"
+)
+
+func prepares(px *Paxos) int {
+	return px.PhaseStats()[PhasePrepare].Count
+}
+
+func TestMultiPaxos(t *testing.T) {
+	const npaxos = 3
+	pxa, _ := makePeers("multi", npaxos, func(i int) []Option {
+		return []Option{WithMultiPaxos()}
+	})
+	defer cleanup(pxa)
+
+	// the first proposal prepares, and makes peer 0 the leader.
+	pxa[0].Start(0, 0)
+	waitn(t, pxa, 0, npaxos)
+	if prepares(pxa[0]) == 0 {
+		t.Fatalf("the first proposal did not prepare")
+	}
+
+	// the leader goes straight to accept; the others forward.
+	before := prepares(pxa[0])
+	for seq := 1; seq < 10; seq++ {
+		pxa[seq%npaxos].Start(seq, seq*10)
+		waitn(t, pxa, seq, npaxos)
+	}
+	if n := prepares(pxa[0]); n != before {
+		t.Fatalf("the leader prepared %v more times", n-before)
+	}
+	for i := 1; i < npaxos; i++ {
+		if n := prepares(pxa[i]); n != 0 {
+			t.Fatalf("follower %v prepared %v times", i, n)
+		}
+	}
+
+	// the leader dies; another peer takes over, with one more
+	// prepare, and leads from then on.
+	pxa[0].Kill()
+	pxa[0] = nil
+	pxa[1].Start(10, 100)
+	waitn(t, pxa, 10, npaxos-1)
+	before = prepares(pxa[1])
+	if before == 0 {
+		t.Fatalf("the new leader did not prepare")
+	}
+	for seq := 11; seq < 20; seq++ {
+		pxa[1+seq%2].Start(seq, seq*10)
+		waitn(t, pxa, seq, npaxos-1)
+	}
+	if n := prepares(pxa[1]); n != before {
+		t.Fatalf("the new leader prepared %v more times", n-before)
+	}
+
+	// two peers that both think they lead still agree.
+	for seq := 20; seq < 30; seq++ {
+		pxa[1].Start(seq, seq*10)
+		pxa[2].Start(seq, seq*10+1)
+	}
+	for seq := 20; seq < 30; seq++ {
+		waitn(t, pxa, seq, npaxos-1)
+	}
+}
@@ -0,0 +1,58 @@
+package paxos
+
+//
+// decision notification, so that applications need not poll
+// Status().
+//
+
+//
+// return a channel that receives the value decided for seq as
+// soon as this peer learns it (right away if it already has).
+// the channel is closed without a value if seq is forgotten
+// before this peer learns it, or if the peer is killed; call
+// Status() to tell which.
+//
+func (px *Paxos) Notify(seq int) <-chan interface{} {
+	ch := make(chan interface{}, 1)
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if v, ok := px.impl.instances.decided(seq); ok {
+		ch <- v
+		close(ch)
+	} else if px.isdead() || px.impl.instances.isForgotten(seq) {
+		close(ch)
+	} else {
+		px.impl.waiters[seq] = append(px.impl.waiters[seq], ch)
+	}
+	return ch
+}
+
+//
+// hand v to everyone waiting on seq. caller holds px.mu.
+//
+func (px *Paxos) notifyDecided(seq int, v interface{}) {
+	for _, ch := range px.impl.waiters[seq] {
+		ch <- v
+		close(ch)
+	}
+	delete(px.impl.waiters, seq)
+}
+
+//
+// give up on every seq <= through that is still waited on.
+// caller holds px.mu.
+//
+func (px *Paxos) dropWaiters(through int) {
+	for seq := range px.impl.waiters {
+		if seq <= through {
+			px.closeWaiters(seq)
+		}
+	}
+}
+
+func (px *Paxos) closeWaiters(seq int) {
+	for _, ch := range px.impl.waiters[seq] {
+		close(ch)
+	}
+	delete(px.impl.waiters, seq)
+}
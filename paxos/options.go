@@ -0,0 +1,119 @@
+package paxos
+
+import (
+	"umich.edu/eecs491/proj5/common"
+)
+
+//
+// optional settings that the application can hand to
+// paxos.Make(). a Make() call without options gives
+// the classic in-memory peer.
+//
+type Option func(px *Paxos)
+
+//
+// keep acceptor state (promises, accepts, decisions and
+// Done() calls) in a write-ahead log under dir, so that a
+// peer can crash, restart with the same dir, and carry on
+// without breaking the promises it made before the crash.
+//
+func WithStorage(dir string) Option {
+	return func(px *Paxos) {
+		px.impl.storageDir = dir
+	}
+}
+
+//
+// send and accept this peer's RPCs through t instead of
+// common.Call() and common.Listen(), e.g. through
+// common.SimNetwork's Endpoint(peers[me]) in tests.
+//
+func WithTransport(t common.Transport) Option {
+	return func(px *Paxos) {
+		px.impl.transport = t
+	}
+}
+
+//
+// run in Multi-Paxos mode: a peer whose prepare succeeds
+// keeps its ballot for all later instances and skips the
+// prepare phase until a higher ballot shows up. the other
+// peers forward the values passed to Start() to it.
+//
+func WithMultiPaxos() Option {
+	return func(px *Paxos) {
+		px.impl.multiPaxos = true
+	}
+}
+
+//
+// allow membership changes: Reconfig values (see AddPeer and
+// RemovePeer) decided through the log change the set of peers
+// that make up a majority, Alpha instances later.
+//
+func WithReconfig() Option {
+	return func(px *Paxos) {
+		px.impl.reconfigurable = true
+	}
+}
+
+//
+// start a peer that joins a running group. peers lists the
+// group's current members plus this peer (peers[me]), which
+// is not counted as a member until an AddPeer for it takes
+// effect. the others keep the instances it has not caught up on
+// yet, so to replace a dead member, add the new peer before
+// removing the dead one. implies WithReconfig.
+//
+func WithJoin() Option {
+	return func(px *Paxos) {
+		px.impl.reconfigurable = true
+		px.impl.joining = true
+	}
+}
+
+//
+// make the listed peers (a subset of the peers given to Make())
+// learners: they hear every decision and catch up like members,
+// but are never asked to Prepare or Accept and do not count
+// toward a majority. every peer, learners included, must be
+// given the same list.
+//
+func WithLearners(learners ...string) Option {
+	return func(px *Paxos) {
+		px.impl.learnerPorts = make(map[string]bool)
+		for _, peer := range learners {
+			px.impl.learnerPorts[peer] = true
+		}
+	}
+}
+
+//
+// grant leader leases (see lease.go): while one peer holds the
+// lease, the others forward the values passed to Start() to it,
+// and it can serve reads without agreeing on them first (see
+// HoldsLease). every peer must be given this option.
+//
+func WithLeases() Option {
+	return func(px *Paxos) {
+		px.impl.leases = true
+	}
+}
+
+//
+// authenticate every RPC to and from the peers with key (see
+// common.SetKey), including those a Reconfig adds later. every
+// peer must be given the same key; a nil key leaves RPCs
+// unauthenticated.
+//
+func WithKey(key []byte) Option {
+	return func(px *Paxos) {
+		if key == nil {
+			return
+		}
+		px.impl.key = key
+		for _, peer := range px.peers {
+			common.SetKey(peer, key)
+		}
+	}
+}
@@ -6,18 +6,28 @@ package paxos
 // a Paxos peer.
 //
 // Manages a sequence of agreed-on values.
-// The set of peers is fixed.
+// The set of peers is fixed, unless changed with WithReconfig.
+// Peers named in WithLearners only learn decisions; they do not vote.
 // Copes with network failures (partition, msg loss, etc.).
-// Does not store anything persistently, so cannot handle crash+restart.
+// Peers that missed decisions fetch them from the others in the
+// background (see catchup.go).
+// Can keep its acceptor state in a write-ahead log (see WithStorage),
+// so that a peer restarted on the same directory survives crash+restart.
+// Without storage nothing is persistent.
 //
 // The application interface:
 //
-// px = paxos.Make(peers []string, me string)
+// px = paxos.Make(peers []string, me string, rpcs, opts...)
 // px.Start(seq int, v interface{}) -- start agreement on new instance
+// px.StartContext(ctx, seq int, v interface{}) -- same, cancelled with ctx
 // px.Status(seq int) (Fate, v interface{}) -- get info about an instance
 // px.Done(seq int) -- ok to forget all instances <= seq
 // px.Max() int -- highest instance seq known, or -1
 // px.Min() int -- instances before this seq have been forgotten
+// px.Notify(seq int) <-chan interface{} -- the value, once decided
+// px.Suspects() []string -- members and learners not heard from for DeadAfter
+// px.Learners() []string -- the non-voting peers (see WithLearners)
+// Paxos.Inspect RPC -- the peer's state, for debugging (see cmd/paxosdump)
 //
 
 import (
@@ -26,10 +36,10 @@ import (
 	"math/rand"
 	"net"
 	"net/rpc"
-	"os"
-	"syscall"
 	"sync"
 	"sync/atomic"
+
+	"umich.edu/eecs491/proj5/common"
 )
 
 
@@ -65,6 +75,7 @@ func (px *Paxos) Kill() {
 	if px.l != nil {
 		px.l.Close()
 	}
+	px.killImpl()
 }
 
 //
@@ -90,11 +101,15 @@ func (px *Paxos) isunreliable() bool {
 // the application wants to create a paxos peer.
 // the ports of all the paxos peers (including this one)
 // are in peers[]. this server's port is peers[me].
+// opts are optional settings, e.g. WithStorage(dir).
 //
-func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
+func Make(peers []string, me int, rpcs *rpc.Server, opts ...Option) *Paxos {
 	px := &Paxos{}
 	px.peers = peers
 	px.me = me
+	for _, opt := range opts {
+		opt(px)
+	}
 
 	px.initImpl()
 
@@ -106,9 +121,8 @@ func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
 		rpcs.Register(px)
 
 		// prepare to receive connections from clients.
-		// change "unix" to "tcp" to use over a network.
-		os.Remove(peers[me]) // only needed for "unix"
-		l, e := net.Listen("unix", peers[me])
+		// peers[me] may be a unix socket path or a TCP host:port.
+		l, e := px.listen(peers[me])
 		if e != nil {
 			log.Fatal("listen error: ", e)
 		}
@@ -124,17 +138,20 @@ func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
 						conn.Close()
 					} else if px.isunreliable() && (rand.Int63()%1000) < 200 {
 						// process the request but force discard of reply.
-						c1 := conn.(*net.UnixConn)
-						f, _ := c1.File()
-						err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
+						err := common.CloseWrite(conn)
 						if err != nil {
 							fmt.Printf("shutdown: %v\n", err)
 						}
 						atomic.AddInt32(&px.rpcCount, 1)
-						go rpcs.ServeConn(conn)
+						go common.ServeConn(rpcs, conn, peers[me])
+					} else if px.isunreliable() {
+						// keep rolling the dice for each request
+						// on this connection.
+						atomic.AddInt32(&px.rpcCount, 1)
+						go common.ServeUnreliable(rpcs, conn, px.isunreliable, peers[me])
 					} else {
 						atomic.AddInt32(&px.rpcCount, 1)
-						go rpcs.ServeConn(conn)
+						go common.ServeConn(rpcs, conn, peers[me])
 					}
 				} else if err == nil {
 					conn.Close()
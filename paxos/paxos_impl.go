@@ -1,7 +1,13 @@
 package paxos
 
 import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
 	"time"
+
 	"umich.edu/eecs491/proj5/common"
 )
 
@@ -12,42 +18,266 @@ const (
 	NotProposing        = 2
 )
 
+//
+// Id is the proposer's port rather than its index: a peer that
+// joined later (see WithJoin) may number the peers differently.
+//
 type ProposalNumber struct {
 	Number int
-	Id     int
+	Id     string
 }
 
+// leaderId and grantedTo when there is none.
+const NoLeader = ""
+
 //
 // additions to Paxos state.
 //
 type PaxosImpl struct {
-	// a log of instances agreement
-	instanceLog map[int]interface{}
-	// np, na, va
-	np map[int]ProposalNumber
-	na map[int]ProposalNumber
-	va map[int]interface{}
+	// np, na, va and the decided value of every instance
+	instances *instanceStore
 	// local highest done seq number (init -1)
 	localDone int
 	// universal highest done seq number (init -1)
 	peersDone []int
+	// RPC transport, nil for common.CallAs() and common.Listen()
+	transport common.Transport
+	// see WithKey; also set for every peer a Reconfig adds
+	key []byte
+	// this peer's port, peers[me]
+	addr string
+	// write-ahead log directory ("" keeps everything in memory)
+	storageDir string
+	// write-ahead log, nil once the peer has been killed
+	storage *storage
+	// multi-paxos acceptor: promise npAll for every instance >= allFrom
+	multiPaxos bool
+	hasNpAll   bool
+	npAll      ProposalNumber
+	allFrom    int
+	// multi-paxos proposer: our ballot, if leading, covers every
+	// instance >= leadFrom; proposals holds the one value per
+	// instance that may go out under that ballot, seeded with the
+	// accepted values the prepare quorum reported
+	leading   bool
+	ballot    ProposalNumber
+	leadFrom  int
+	leadEpoch int
+	proposals map[int]AcceptedInstance
+	// best guess at the current leader's port, NoLeader if unknown
+	leaderId string
+	// proposer phase latencies, keyed by phase name
+	phaseStats map[string]PhaseStats
+	// membership: epochs are rebuilt from the peers given to Make()
+	// and every Reconfig decided so far (never forgotten)
+	reconfigurable bool
+	joining        bool
+	initialPeers   []string
+	learnerPorts   map[string]bool
+	learners       []int
+	reconfigs      map[int]Reconfig
+	epochs         []epoch
+	// every instance <= decidedThrough is decided (or forgotten)
+	decidedThrough int
+	// catch-up: the highest instance any peer mentioned
+	maxKnown int
+	// Done() gossip: when each peer was last heard from, and
+	// the peers with a heartbeat in flight
+	started   time.Time
+	lastHeard map[string]time.Time
+	beating   map[string]bool
+	// Notify() channels per undecided instance
+	waiters map[int][]chan interface{}
+	// the running proposer per instance; ctx is cancelled by Kill()
+	proposers map[int]*proposal
+	ctx       context.Context
+	stop      context.CancelFunc
+	// leader leases: the lease granted as an acceptor (NoLeader
+	// if none), the one held as a proposer, and the holder some
+	// acceptor last named
+	leases       bool
+	grantedTo    string
+	grantExpiry  time.Time
+	leaseExpiry  time.Time
+	leaseThrough int
+	leaseHint    string
+	// the application's latest snapshot (see SetSnapshot)
+	snapSeq  int
+	snapData []byte
 	// local state
 }
 
+var errKilled = errors.New("paxos peer has been killed")
+
 //
 // your px.impl.* initializations here.
 //
 func (px *Paxos) initImpl() {
-	px.impl.instanceLog = make(map[int]interface{})
-	px.impl.np = make(map[int]ProposalNumber)
-	px.impl.na = make(map[int]ProposalNumber)
-	px.impl.va = make(map[int]interface{})
+	px.impl.instances = newInstanceStore()
+	px.impl.addr = px.peers[px.me]
 	px.impl.localDone = InitDone
+	px.impl.proposals = make(map[int]AcceptedInstance)
+	px.impl.phaseStats = make(map[string]PhaseStats)
+	px.impl.waiters = make(map[int][]chan interface{})
+	px.impl.proposers = make(map[int]*proposal)
+	px.impl.ctx, px.impl.stop = context.WithCancel(context.Background())
+	px.impl.started = time.Now()
+	px.impl.lastHeard = make(map[string]time.Time)
+	px.impl.beating = make(map[string]bool)
+	px.impl.leaderId = NoLeader
+	px.impl.grantedTo = NoLeader
+	px.impl.leaseThrough = -1
+	px.impl.snapSeq = -1
 	numPeers := len(px.peers)
 	px.impl.peersDone = make([]int, numPeers)
 	for i := 0; i < numPeers; i++ {
 		px.impl.peersDone[i] = InitDone
 	}
+	px.impl.initialPeers = make([]string, numPeers)
+	copy(px.impl.initialPeers, px.peers)
+	px.impl.reconfigs = make(map[int]Reconfig)
+	px.impl.decidedThrough = -1
+	px.impl.maxKnown = -1
+	px.rebuildMembership()
+	if px.impl.storageDir != "" {
+		st, recs, err := openStorage(px.impl.storageDir)
+		if err != nil {
+			log.Fatalf("Paxos(%v) open storage: %v", px.me, err)
+		}
+		px.impl.storage = st
+		px.recoverImpl(recs)
+		if px.impl.leases {
+			px.impl.grantedTo = leaseUnknown
+			px.impl.grantExpiry = time.Now().Add(LeaseDuration)
+		}
+	}
+	go px.catchUpLoop()
+	go px.heartbeatLoop()
+	if px.impl.leases {
+		go px.leaseLoop()
+	}
+}
+
+//
+// rebuild px.impl.* from the records of the write-ahead log.
+//
+func (px *Paxos) recoverImpl(recs []walRecord) {
+	for _, rec := range recs {
+		switch rec.Kind {
+		case recPromise:
+			px.impl.instances.setPromise(rec.Seq, rec.N)
+		case recAccept:
+			px.impl.instances.accept(rec.Seq, rec.N, rec.V)
+		case recDecide:
+			px.impl.instances.decide(rec.Seq, rec.V)
+			// before a later recForget drops the instance.
+			if rc, ok := rec.V.(Reconfig); ok && px.impl.reconfigurable {
+				px.impl.reconfigs[rec.Seq] = rc
+			}
+		case recDone:
+			px.impl.localDone = rec.Seq
+			px.impl.peersDone[px.me] = rec.Seq
+		case recPromiseAll:
+			px.impl.hasNpAll = true
+			px.impl.npAll = rec.N
+			px.impl.allFrom = rec.Seq
+		case recReconfig:
+			if rc, ok := rec.V.(Reconfig); ok {
+				px.impl.reconfigs[rec.Seq] = rc
+			}
+		case recForget:
+			px.impl.instances.forget(rec.Seq)
+		}
+	}
+	px.impl.instances.each(0, func(seq int, inst *instance) {
+		px.noteSeq(seq)
+	})
+	px.rebuildMembership()
+	px.advanceDecided(px.impl.localDone)
+}
+
+//
+// make rec durable before the caller acts on it. caller holds
+// px.mu. returns false if the peer has been killed, in which
+// case the caller must not reply as if the change was made.
+//
+func (px *Paxos) persist(rec walRecord) bool {
+	if px.impl.storageDir == "" {
+		return true
+	}
+	if px.impl.storage == nil {
+		return false
+	}
+	if err := px.impl.storage.append(rec); err != nil {
+		log.Fatalf("Paxos(%v) write storage: %v", px.me, err)
+	}
+	return true
+}
+
+//
+// rewrite the write-ahead log from the current state once it
+// has grown enough. caller holds px.mu.
+//
+func (px *Paxos) compactStorage() {
+	st := px.impl.storage
+	if st == nil || !st.needsCompaction() {
+		return
+	}
+	recs := []walRecord{{Kind: recForget, Seq: px.impl.instances.base}}
+	px.impl.instances.each(0, func(seq int, inst *instance) {
+		if inst.hasNa {
+			recs = append(recs, walRecord{Kind: recAccept, Seq: seq, N: inst.na, V: inst.va})
+		}
+		if inst.hasNp && (!inst.hasNa || inst.np != inst.na) {
+			recs = append(recs, walRecord{Kind: recPromise, Seq: seq, N: inst.np})
+		}
+		if inst.decided {
+			recs = append(recs, walRecord{Kind: recDecide, Seq: seq, V: inst.v})
+		}
+	})
+	recs = append(recs, walRecord{Kind: recDone, Seq: px.impl.localDone})
+	if px.impl.hasNpAll {
+		recs = append(recs, walRecord{Kind: recPromiseAll, Seq: px.impl.allFrom, N: px.impl.npAll})
+	}
+	for seq, rc := range px.impl.reconfigs {
+		recs = append(recs, walRecord{Kind: recReconfig, Seq: seq, V: rc})
+	}
+	if err := st.compact(recs); err != nil {
+		log.Fatalf("Paxos(%v) compact storage: %v", px.me, err)
+	}
+}
+
+//
+// release px.impl.* resources when the peer is killed.
+//
+func (px *Paxos) killImpl() {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if px.impl.storage != nil {
+		px.impl.storage.close()
+		px.impl.storage = nil
+	}
+	for seq := range px.impl.waiters {
+		px.closeWaiters(seq)
+	}
+	px.impl.stop()
+}
+
+//
+// send an RPC to srv through this peer's transport.
+//
+func (px *Paxos) call(srv string, rpcname string, args interface{}, reply interface{}) bool {
+	if px.impl.transport != nil {
+		return px.impl.transport.Call(srv, rpcname, args, reply)
+	}
+	return common.CallAs(px.impl.addr, srv, rpcname, args, reply)
+}
+
+func (px *Paxos) listen(addr string) (net.Listener, error) {
+	if px.impl.transport != nil {
+		return px.impl.transport.Listen(addr)
+	}
+	return common.Listen(addr)
 }
 
 func FindMaxProposal(seen_np []int) int {
@@ -76,22 +306,35 @@ func FindValue(seen_na []ProposalNumber) int {
 
 // todo: local prepare?
 
+//
+// the promise in effect for seq: the higher of the
+// per-instance promise and the multi-paxos promise.
+// caller holds px.mu.
+//
+func (px *Paxos) promised(seq int) (ProposalNumber, bool) {
+	np, ok := px.impl.instances.promise(seq)
+	if px.impl.hasNpAll && seq >= px.impl.allFrom && (!ok || px.impl.npAll.Number > np.Number) {
+		return px.impl.npAll, true
+	}
+	return np, ok
+}
+
 func (px *Paxos) LocalAccept(seq int, v interface{}, n ProposalNumber) bool {
 	px.mu.Lock()
 	defer px.mu.Unlock()
-	if n.Number > px.impl.np[seq].Number {
-		px.impl.np[seq] = n
-		px.impl.na[seq] = n
-		px.impl.va[seq] = v
-		return true
-	} else if n.Number == px.impl.np[seq].Number {
-		if n.Id == px.impl.np[seq].Id {
-			px.impl.np[seq] = n
-			px.impl.na[seq] = n
-			px.impl.va[seq] = v
-			return true
+	if px.leaseBlocks(n.Id) || px.impl.instances.isForgotten(seq) {
+		return false
+	}
+	np, isPromised := px.promised(seq)
+	if !isPromised || n.Number > np.Number {
+		px.impl.instances.accept(seq, n, v)
+		return px.persist(walRecord{Kind: recAccept, Seq: seq, N: n, V: v})
+	} else if n.Number == np.Number {
+		if n.Id == np.Id {
+			px.impl.instances.accept(seq, n, v)
+			return px.persist(walRecord{Kind: recAccept, Seq: seq, N: n, V: v})
 		} else {
-			//log.Printf("Proposer %v and Proposer %v both enter accept phase with proposal number %v", px.impl.np[seq].Id, n.Id, n.Number)
+			//log.Printf("Proposer %v and Proposer %v both enter accept phase with proposal number %v", np.Id, n.Id, n.Number)
 			return false
 		}
 	} else {
@@ -104,11 +347,12 @@ func (px *Paxos) LocalLearn(seq int, v interface{}) bool {
 	defer px.mu.Unlock()
 	// if Seq not in log and Seq is greater than local highest done seq number, succeed
 	if seq > px.impl.localDone {
-		if _, ok := px.impl.instanceLog[seq]; ok {
+		if _, ok := px.impl.instances.decided(seq); ok {
 			return true
 		} else {
-			px.impl.instanceLog[seq] = v
-			return true
+			px.impl.instances.decide(seq, v)
+			px.noteDecided(seq, v)
+			return px.persist(walRecord{Kind: recDecide, Seq: seq, V: v})
 		}
 	} else {
 		return false
@@ -116,13 +360,22 @@ func (px *Paxos) LocalLearn(seq int, v interface{}) bool {
 }
 
 func (px *Paxos) PreparePhase(seq int, v interface{}, seen_np *[]int, n *ProposalNumber) (bool, interface{}) {
+	return px.preparePhase(seq, v, seen_np, n, false)
+}
+
+//
+// with all set, ask for a multi-paxos promise covering every
+// instance >= seq, and on success become the leader.
+//
+func (px *Paxos) preparePhase(seq int, v interface{}, seen_np *[]int, n *ProposalNumber, all bool) (bool, interface{}) {
+	span := common.StartSpan(px.proposerTrace(seq), px.impl.addr, "Paxos.prepare")
 	px.mu.Lock()
 	var seen_na []ProposalNumber
 	var seen_va []interface{}
-	majority := len(px.peers)/2 + 1
+	recovered := make(map[int]AcceptedInstance)
 	if len(*seen_np) == 0 {
-		if _, isPromised := px.impl.np[seq]; isPromised {
-			n.Number = px.impl.np[seq].Number + 1
+		if np, isPromised := px.promised(seq); isPromised {
+			n.Number = np.Number + 1
 		} else {
 			n.Number = StartProposalNumber
 		}
@@ -131,108 +384,146 @@ func (px *Paxos) PreparePhase(seq int, v interface{}, seen_np *[]int, n *Proposa
 	}
 	px.mu.Unlock()
 	//log.Printf("Start prepare on proposer %v for seq %v with value %v proposal number %v", px.me, seq, v, n.Number)
-	// send prepare to all servers
-	for _, replica := range px.peers {
-		//if idx == px.me {
-		//	majority -= 1
-		//	//selfPrepare()
-		//} else {
-		//
-		//}
-		var prepareArgs = new(PrepareArgs)
+	// send prepare to all servers, in parallel
+	var mu sync.Mutex // guards the seen_* and recovered, and finished
+	finished := false
+	var prepareArgs = new(PrepareArgs)
+	prepareArgs.Seq = seq
+	prepareArgs.N = *n
+	prepareArgs.All = all
+	prepareArgs.From, prepareArgs.Done = px.doneInfo()
+	prepareArgs.Trace = span.Context()
+	peers, members, majority := px.quorum(seq)
+	start := time.Now()
+	isPrepare := px.fanOut(members, majority, func(idx int) bool {
 		var prepareReply = new(PrepareReply)
-		prepareArgs.Seq = seq
-		prepareArgs.N = *n
-		ok := common.Call(replica, "Paxos.Prepare", &prepareArgs, &prepareReply)
+		ok := px.call(peers[idx], "Paxos.Prepare", prepareArgs, prepareReply)
 		if ok {
-			*seen_np = append(*seen_np, prepareReply.Np.Number)
-			if prepareReply.Response == OK {
-				majority -= 1
-				seen_na = append(seen_na, prepareReply.Na)
-				seen_va = append(seen_va, prepareReply.Va)
-			} else if prepareReply.Response == EmptyOK {
-				majority -= 1
-			}
+			px.noteDone(peers[idx], prepareReply.Done)
 		}
-	}
-	if majority <= 0 {
-		if len(seen_na) == 0 {
-			return true, v
-		} else {
+		mu.Lock()
+		defer mu.Unlock()
+		if !ok || finished {
+			return false
+		}
+		*seen_np = append(*seen_np, prepareReply.Np.Number)
+		if prepareReply.Response == Reject {
+			px.noteHolder(prepareReply.LeasedTo)
+			return false
+		}
+		mergeAccepted(recovered, prepareReply.Accepted)
+		if prepareReply.Response == OK {
+			seen_na = append(seen_na, prepareReply.Na)
+			seen_va = append(seen_va, prepareReply.Va)
+		}
+		return true
+	})
+	px.recordPhase(PhasePrepare, time.Since(start))
+	span.End()
+	mu.Lock()
+	defer mu.Unlock()
+	finished = true
+	if isPrepare {
+		if len(seen_na) != 0 {
 			idx := FindValue(seen_na)
-			return true, seen_va[idx]
+			v = seen_va[idx]
 		}
+		if all {
+			recovered[seq] = AcceptedInstance{Seq: seq, Na: *n, Va: v}
+			px.lead(seq, *n, recovered)
+		}
+		return true, v
 	} else {
 		return false, v
 	}
 }
 
 func (px *Paxos) AcceptPhase(seq int, v interface{}, n ProposalNumber) bool {
-	majority := len(px.peers)/2 + 1
-	for idx, replica := range px.peers {
-		if idx == px.me {
-			if px.LocalAccept(seq, v, n) {
-				majority -= 1
-			}
-			continue
+	var acceptArgs = new(AcceptArgs)
+	acceptArgs.Seq = seq
+	acceptArgs.N = n
+	acceptArgs.V = v
+	acceptArgs.From, acceptArgs.Done = px.doneInfo()
+	span := common.StartSpan(px.proposerTrace(seq), px.impl.addr, "Paxos.accept")
+	acceptArgs.Trace = span.Context()
+	peers, members, majority := px.quorum(seq)
+	start := time.Now()
+	isAccept := px.fanOut(members, majority, func(idx int) bool {
+		if peers[idx] == px.self() {
+			return px.LocalAccept(seq, v, n)
 		}
-		var acceptArgs = new(AcceptArgs)
 		var acceptReply = new(AcceptReply)
-		acceptArgs.Seq = seq
-		acceptArgs.N = n
-		acceptArgs.V = v
-		ok := common.Call(replica, "Paxos.Accept", &acceptArgs, &acceptReply)
+		ok := px.call(peers[idx], "Paxos.Accept", acceptArgs, acceptReply)
 		if ok {
-			if acceptReply.Response == OK {
-				majority -= 1
-			}
+			px.noteDone(peers[idx], acceptReply.Done)
+			px.noteHolder(acceptReply.LeasedTo)
 		}
-	}
-	if majority <= 0 {
-		return true
-	} else {
-		return false
-	}
+		return ok && acceptReply.Response == OK
+	})
+	px.recordPhase(PhaseAccept, time.Since(start))
+	span.End()
+	return isAccept
 }
 
 func (px *Paxos) LearnPhase(seq int, v interface{}, n ProposalNumber) {
-	for idx, replica := range px.peers {
-		if idx == px.me {
-			px.LocalLearn(seq, v)
-			continue
+	var decidedArgs = new(DecidedArgs)
+	decidedArgs.Seq = seq
+	decidedArgs.V = v
+	decidedArgs.N = n
+	span := common.StartSpan(px.proposerTrace(seq), px.impl.addr, "Paxos.learn")
+	decidedArgs.Trace = span.Context()
+	start := time.Now()
+	// learn locally first, so that a peer this decision adds
+	// is among the learners and hears about its own addition.
+	px.LocalLearn(seq, v)
+	peers, targets, need := px.learners(seq)
+	px.fanOut(targets, need, func(idx int) bool {
+		if peers[idx] == px.self() {
+			return true
 		}
-		var decidedArgs = new(DecidedArgs)
 		var decidedReply = new(DecidedReply)
-		decidedArgs.Seq = seq
-		decidedArgs.V = v
-		decidedArgs.N = n
-		ok := common.Call(replica, "Paxos.Learn", &decidedArgs, &decidedReply)
+		ok := px.call(peers[idx], "Paxos.Learn", decidedArgs, decidedReply)
 		if ok {
-			px.mu.Lock()
-			px.impl.peersDone[idx] = decidedReply.Done
-			px.mu.Unlock()
+			px.noteDone(peers[idx], decidedReply.Done)
 		}
-	}
+		return ok
+	})
+	px.recordPhase(PhaseLearn, time.Since(start))
+	span.End()
 	px.Forget()
 }
 
-func (px *Paxos) Proposer(seq int, v interface{}) {
+//
+// drive seq to a decision, until ctx is done (see propose()).
+//
+func (px *Paxos) Proposer(ctx context.Context, seq int, v interface{}) {
+	if !px.waitForWindow(ctx, seq) {
+		return
+	}
+	if px.impl.leases && px.forwardToHolder(ctx, seq, v) {
+		return
+	}
+	if px.impl.multiPaxos && px.leaderPropose(ctx, seq, v) {
+		return
+	}
 	var seen_np []int
 	var n ProposalNumber
-	n.Id = px.me
+	n.Id = px.impl.addr
 	for {
-		px.mu.Lock()
-		_, isDecided := px.impl.instanceLog[seq]
-		px.mu.Unlock()
-		if isDecided {
+		if px.proposalOver(ctx, seq) {
 			break
 		}
 		// phase 1: Prepare
 		isPrepare := false
 		for !isPrepare {
 			duration := time.Duration(10 * (px.me + 1))
-			time.Sleep(duration * time.Millisecond)
-			isPrepare, v = px.PreparePhase(seq, v, &seen_np, &n)
+			if !sleepContext(ctx, duration*time.Millisecond) || px.proposalOver(ctx, seq) {
+				return
+			}
+			if px.impl.leases && px.forwardToHolder(ctx, seq, v) {
+				return
+			}
+			isPrepare, v = px.preparePhase(seq, v, &seen_np, &n, px.impl.multiPaxos)
 		}
 		// phase 2: Accept
 		//log.Printf("Start accept on proposer %v for seq %v with value %v", px.me, seq, v)
@@ -251,26 +542,21 @@ func (px *Paxos) Forget() {
 	// forget log that is fewer than universal highest done seq number
 	universalMin := px.Min()
 	px.mu.Lock()
-	for k, _ := range px.impl.instanceLog {
-		if k < universalMin {
-			delete(px.impl.instanceLog, k)
-		}
+	// and whatever the snapshot covers, whoever else still needs it.
+	if s := px.snapshotThrough() + 1; s > universalMin {
+		universalMin = s
 	}
-	for k, _ := range px.impl.np {
-		if k < universalMin {
-			delete(px.impl.np, k)
-		}
+	px.advanceDecided(universalMin - 1)
+	px.dropWaiters(universalMin - 1)
+	for k := px.impl.instances.base; k < universalMin; k++ {
+		delete(px.impl.proposals, k)
 	}
-	for k, _ := range px.impl.na {
-		if k < universalMin {
-			delete(px.impl.na, k)
-		}
-	}
-	for k, _ := range px.impl.va {
-		if k < universalMin {
-			delete(px.impl.va, k)
-		}
+	if universalMin > px.impl.instances.base {
+		px.impl.instances.forget(universalMin)
+		// or a restart would bring the instances back.
+		px.persist(walRecord{Kind: recForget, Seq: universalMin})
 	}
+	px.compactStorage()
 	px.mu.Unlock()
 }
 
@@ -279,11 +565,11 @@ func (px *Paxos) Forget() {
 // instance seq, with proposed value v.
 // Start() returns right away; the application will
 // call Status() to find out if/when agreement
-// is reached.
+// is reached. a seq that already has a proposer
+// running here keeps that one (see StartContext).
 //
 func (px *Paxos) Start(seq int, v interface{}) {
-	// Start a thread for proposer
-	go px.Proposer(seq, v)
+	px.StartContext(context.Background(), seq, v)
 }
 
 //
@@ -297,6 +583,8 @@ func (px *Paxos) Done(seq int) {
 	px.mu.Lock()
 	px.impl.localDone = seq
 	px.impl.peersDone[px.me] = seq
+	px.advanceDecided(seq)
+	px.persist(walRecord{Kind: recDone, Seq: seq})
 	px.mu.Unlock()
 	px.Forget()
 }
@@ -309,16 +597,7 @@ func (px *Paxos) Done(seq int) {
 func (px *Paxos) Max() int {
 	px.mu.Lock()
 	defer px.mu.Unlock()
-	if len(px.impl.instanceLog) == 0 {
-		return -1
-	}
-	maxNumber := -1
-	for seq, _ := range px.impl.instanceLog {
-		if seq > maxNumber {
-			maxNumber = seq
-		}
-	}
-	return maxNumber
+	return px.impl.instances.max
 }
 
 //
@@ -352,10 +631,13 @@ func (px *Paxos) Max() int {
 func (px *Paxos) Min() int {
 	px.mu.Lock()
 	defer px.mu.Unlock()
-	var minNumber int
-	for idx, e := range px.impl.peersDone {
-		if idx == 0 || e < minNumber {
-			minNumber = e
+	// the current members and learners, and this peer even if it is
+	// not (yet) one. a member that joined replays the log from the
+	// start, so its Done() value counts like anyone else's.
+	minNumber := px.impl.peersDone[px.me]
+	for _, idx := range px.followers() {
+		if px.impl.peersDone[idx] < minNumber {
+			minNumber = px.impl.peersDone[idx]
 		}
 	}
 	return minNumber + 1
@@ -370,31 +652,13 @@ func (px *Paxos) Min() int {
 //
 func (px *Paxos) Status(seq int) (Fate, interface{}) {
 	px.mu.Lock()
+	defer px.mu.Unlock()
 	// check local log to determine whether seq has been decided
-	if _, ok := px.impl.instanceLog[seq]; ok {
-		defer px.mu.Unlock()
-		return Decided, px.impl.instanceLog[seq]
+	if v, ok := px.impl.instances.decided(seq); ok {
+		return Decided, v
+	} else if px.impl.instances.isForgotten(seq) {
+		return Forgotten, nil
 	} else {
-		if len(px.impl.instanceLog) == 0 {
-			defer px.mu.Unlock()
-			return Pending, nil
-		} else {
-			var minSeq int
-			for minSeq = range px.impl.instanceLog {
-				break
-			}
-			for k := range px.impl.instanceLog {
-				if k < minSeq {
-					minSeq = k
-				}
-			}
-			if seq < minSeq {
-				px.mu.Unlock()
-				return Forgotten, nil
-			} else {
-				px.mu.Unlock()
-				return Pending, nil
-			}
-		}
+		return Pending, nil
 	}
 }
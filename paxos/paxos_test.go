@@ -0,0 +1,89 @@
+package paxos
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func port(tag string, host int) string {
+	s := "/var/tmp/824-"
+	s += strconv.Itoa(os.Getuid()) + "/"
+	os.Mkdir(s, 0777)
+	s += "px-"
+	s += strconv.Itoa(os.Getpid()) + "-"
+	s += tag + "-"
+	s += strconv.Itoa(host)
+	return s
+}
+
+//
+// start n peers that listen on their ports, each with the
+// options opts(i) returns.
+//
+func makePeers(tag string, n int, opts func(i int) []Option) ([]*Paxos, []string) {
+	pxa := make([]*Paxos, n)
+	pxh := make([]string, n)
+	for i := 0; i < n; i++ {
+		pxh[i] = port(tag, i)
+	}
+	for i := 0; i < n; i++ {
+		var o []Option
+		if opts != nil {
+			o = opts(i)
+		}
+		pxa[i] = Make(pxh, i, nil, o...)
+	}
+	return pxa, pxh
+}
+
+func cleanup(pxa []*Paxos) {
+	for i := 0; i < len(pxa); i++ {
+		if pxa[i] != nil {
+			pxa[i].Kill()
+		}
+	}
+}
+
+//
+// how many of the peers have decided seq; fails if two of
+// them decided different values.
+//
+func ndecided(t *testing.T, pxa []*Paxos, seq int) int {
+	count := 0
+	var v interface{}
+	for i := 0; i < len(pxa); i++ {
+		if pxa[i] == nil {
+			continue
+		}
+		if fate, v1 := pxa[i].Status(seq); fate == Decided {
+			if count > 0 && v != v1 {
+				t.Fatalf("decided values do not match; seq=%v i=%v v=%v v1=%v",
+					seq, i, v, v1)
+			}
+			count++
+			v = v1
+		}
+	}
+	return count
+}
+
+//
+// wait for at least wanted peers to decide seq.
+//
+func waitn(t *testing.T, pxa []*Paxos, seq int, wanted int) {
+	to := 10 * time.Millisecond
+	for iters := 0; iters < 30; iters++ {
+		if ndecided(t, pxa, seq) >= wanted {
+			break
+		}
+		time.Sleep(to)
+		if to < time.Second {
+			to *= 2
+		}
+	}
+	if nd := ndecided(t, pxa, seq); nd < wanted {
+		t.Fatalf("too few decided; seq=%v ndecided=%v wanted=%v", seq, nd, wanted)
+	}
+}
@@ -0,0 +1,140 @@
+package paxos
+
+import (
+	"context"
+	"time"
+
+	"umich.edu/eecs491/proj5/common"
+)
+
+//
+// proposer bookkeeping.
+//
+// a peer runs at most one proposer per instance: a Start() for
+// a seq that already has a live proposer joins it instead of
+// launching another (and its value is dropped; Start() never
+// promised that v would be the one decided). a proposer stops
+// once seq is decided or forgotten, once every caller that
+// joined it has cancelled its context, or when the peer is
+// killed. a proposer started with a traced context (see
+// common.WithTrace) records its phases in that trace.
+//
+
+type proposal struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	callers int // contexts that can still be cancelled
+	trace   common.TraceContext
+}
+
+//
+// like Start(), but the proposer gives up once ctx is done and
+// every other caller waiting on the same seq has given up too.
+//
+func (px *Paxos) StartContext(ctx context.Context, seq int, v interface{}) {
+	px.mu.Lock()
+	px.noteSeq(seq)
+	px.mu.Unlock()
+	px.propose(ctx, seq, v)
+}
+
+//
+// join the proposer for seq, starting one if there is none.
+//
+func (px *Paxos) propose(ctx context.Context, seq int, v interface{}) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	p, running := px.impl.proposers[seq]
+	if !running || p.ctx.Err() != nil {
+		p = &proposal{}
+		p.ctx, p.cancel = context.WithCancel(px.impl.ctx)
+		span := common.StartSpan(common.TraceFrom(ctx), px.impl.addr, "Paxos.Proposer")
+		p.trace = span.Context()
+		px.impl.proposers[seq] = p
+		go func() {
+			defer px.finishProposal(seq, p)
+			defer span.End()
+			px.Proposer(p.ctx, seq, v)
+		}()
+	}
+	if ctx.Done() == nil {
+		// never cancelled: the proposer runs until it is done.
+		p.callers = -1
+		return
+	}
+	if p.callers >= 0 {
+		p.callers += 1
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			px.release(p)
+		case <-p.ctx.Done():
+		}
+	}()
+}
+
+//
+// one caller of p has given up.
+//
+func (px *Paxos) release(p *proposal) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if p.callers < 0 {
+		return
+	}
+	p.callers -= 1
+	if p.callers == 0 {
+		p.cancel()
+	}
+}
+
+func (px *Paxos) finishProposal(seq int, p *proposal) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	p.cancel()
+	if px.impl.proposers[seq] == p {
+		delete(px.impl.proposers, seq)
+	}
+}
+
+//
+// the trace of the proposer running for seq, if any.
+//
+func (px *Paxos) proposerTrace(seq int) common.TraceContext {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if p, running := px.impl.proposers[seq]; running {
+		return p.trace
+	}
+	return common.TraceContext{}
+}
+
+//
+// should the proposer for seq stop? decided, forgotten,
+// cancelled or killed.
+//
+func (px *Paxos) proposalOver(ctx context.Context, seq int) bool {
+	if ctx.Err() != nil || px.isdead() {
+		return true
+	}
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	_, isDecided := px.impl.instances.decided(seq)
+	return isDecided || px.impl.instances.isForgotten(seq)
+}
+
+//
+// sleep for d, or less if ctx is done first. returns false
+// if ctx is done.
+//
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,48 @@
+package paxos
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func running(px *Paxos) int {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return len(px.impl.proposers)
+}
+
+//
+// wait for px to have wanted proposers left.
+//
+func waitRunning(t *testing.T, px *Paxos, wanted int) {
+	for iters := 0; iters < 50 && running(px) != wanted; iters++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := running(px); n != wanted {
+		t.Fatalf("%v proposers running, wanted %v", n, wanted)
+	}
+}
+
+func TestProposerStops(t *testing.T) {
+	// the other two peers never start, so nothing gets decided.
+	pxh := []string{port("stop", 0), port("stop", 1), port("stop", 2)}
+	px := Make(pxh, 0, nil)
+
+	// one proposer per instance, however many Start()s.
+	px.Start(0, "a")
+	px.Start(0, "b")
+	px.Start(1, "c")
+	waitRunning(t, px, 2)
+
+	// a proposer every caller has given up on stops.
+	ctx, cancel := context.WithCancel(context.Background())
+	px.StartContext(ctx, 2, "d")
+	waitRunning(t, px, 3)
+	cancel()
+	waitRunning(t, px, 2)
+
+	// Kill stops the rest.
+	px.Kill()
+	waitRunning(t, px, 0)
+}
@@ -1,6 +1,11 @@
 package paxos
 
-import "log"
+import (
+	"context"
+	"log"
+
+	"umich.edu/eecs491/proj5/common"
+)
 
 // In all data types that represent RPC arguments/reply, field names
 // must start with capital letters, otherwise RPC will break.
@@ -14,8 +19,12 @@ const (
 type Response string
 
 type PrepareArgs struct {
-	Seq int
-	N   ProposalNumber
+	Seq   int
+	N     ProposalNumber
+	All   bool   // multi-paxos: promise N for every instance >= Seq
+	From  string // the proposer's port
+	Done  int    // the proposer's Done() value
+	Trace common.TraceContext
 }
 
 type PrepareReply struct {
@@ -24,24 +33,39 @@ type PrepareReply struct {
 	Np       ProposalNumber
 	Na       ProposalNumber
 	Va       interface{}
+	Accepted []AcceptedInstance // with All: accepted values above Seq
+	Done     int
+	LeasedTo string // on Reject: the lease holder, if that is why
 }
 
-type AcceptArgs struct {
+type AcceptedInstance struct {
 	Seq int
-	N   ProposalNumber
-	V   interface{}
+	Na  ProposalNumber
+	Va  interface{}
+}
+
+type AcceptArgs struct {
+	Seq   int
+	N     ProposalNumber
+	V     interface{}
+	From  string
+	Done  int
+	Trace common.TraceContext
 }
 
 type AcceptReply struct {
 	Seq      int
 	Response Response
 	N        ProposalNumber
+	Done     int
+	LeasedTo string
 }
 
 type DecidedArgs struct {
-	Seq int
-	V   interface{}
-	N   ProposalNumber
+	Seq   int
+	V     interface{}
+	N     ProposalNumber
+	Trace common.TraceContext
 }
 
 type DecidedReply struct {
@@ -51,55 +75,117 @@ type DecidedReply struct {
 	me       int
 }
 
+type ForwardArgs struct {
+	Seq   int
+	V     interface{}
+	Trace common.TraceContext
+}
+
+type ForwardReply struct {
+	Response Response
+}
+
 func (px *Paxos) Prepare(args *PrepareArgs, reply *PrepareReply) error {
+	span := common.StartSpan(args.Trace, px.impl.addr, "Paxos.Prepare")
+	defer span.End()
 	// could be optimized: put lock into if statement
 	px.mu.Lock()
 	defer px.mu.Unlock()
 	//log.Printf("Receive prepare on replica %v with seq %v proposal number %v from proposer %v", px.me, args.Seq, args.N.Number, args.N.Id)
-	if _, isInNp := px.impl.np[args.Seq]; !isInNp {
-		px.impl.np[args.Seq] = args.N
+	px.noteSeq(args.Seq)
+	px.heard(args.From, args.Done)
+	reply.Done = px.impl.localDone
+	if px.leaseBlocks(args.N.Id) {
+		reply.Response = Reject
+		reply.Seq = args.Seq
+		reply.Np, _ = px.promised(args.Seq)
+		reply.LeasedTo = px.leasedTo()
+		return nil
+	}
+	if args.All {
+		return px.prepareAll(args, reply)
+	}
+	if px.impl.instances.isForgotten(args.Seq) {
+		// decided long ago; no other value can be.
+		reply.Response = Reject
+		reply.Seq = args.Seq
+		return nil
+	}
+	np, isInNp := px.promised(args.Seq)
+	if !isInNp {
+		px.impl.instances.setPromise(args.Seq, args.N)
+		if !px.persist(walRecord{Kind: recPromise, Seq: args.Seq, N: args.N}) {
+			return errKilled
+		}
 		reply.Response = EmptyOK
 		reply.Seq = args.Seq
 		reply.Np = args.N
-	} else if args.N.Number > px.impl.np[args.Seq].Number {
-		px.impl.np[args.Seq] = args.N
+	} else if args.N.Number > np.Number {
+		px.impl.instances.setPromise(args.Seq, args.N)
+		if !px.persist(walRecord{Kind: recPromise, Seq: args.Seq, N: args.N}) {
+			return errKilled
+		}
 		reply.Seq = args.Seq
 		reply.Np = args.N
-		if _, isInNa := px.impl.na[args.Seq]; !isInNa {
+		if na, va, isInNa := px.impl.instances.accepted(args.Seq); !isInNa {
 			reply.Response = EmptyOK
 		} else {
 			reply.Response = OK
-			reply.Na = px.impl.na[args.Seq]
-			reply.Va = px.impl.va[args.Seq]
+			reply.Na = na
+			reply.Va = va
 		}
 	} else {
 		reply.Response = Reject
 		reply.Seq = args.Seq
-		reply.Np = px.impl.np[args.Seq]
+		reply.Np = np
 	}
 	return nil
 }
 
 func (px *Paxos) Accept(args *AcceptArgs, reply *AcceptReply) error {
+	span := common.StartSpan(args.Trace, px.impl.addr, "Paxos.Accept")
+	defer span.End()
 	px.mu.Lock()
 	defer px.mu.Unlock()
-	if args.N.Number > px.impl.np[args.Seq].Number {
-		px.impl.np[args.Seq] = args.N
-		px.impl.na[args.Seq] = args.N
-		px.impl.va[args.Seq] = args.V
+	px.noteSeq(args.Seq)
+	px.heard(args.From, args.Done)
+	reply.Done = px.impl.localDone
+	if px.leaseBlocks(args.N.Id) {
+		reply.Response = Reject
+		reply.Seq = args.Seq
+		reply.N = args.N
+		reply.LeasedTo = px.leasedTo()
+		return nil
+	}
+	if px.impl.instances.isForgotten(args.Seq) {
+		reply.Response = Reject
+		reply.Seq = args.Seq
+		reply.N = args.N
+		return nil
+	}
+	np, isPromised := px.promised(args.Seq)
+	if px.impl.hasNpAll && args.N == px.impl.npAll {
+		px.impl.leaderId = args.N.Id
+	}
+	if !isPromised || args.N.Number > np.Number {
+		px.impl.instances.accept(args.Seq, args.N, args.V)
+		if !px.persist(walRecord{Kind: recAccept, Seq: args.Seq, N: args.N, V: args.V}) {
+			return errKilled
+		}
 		reply.Response = OK
 		reply.Seq = args.Seq
 		reply.N = args.N
-	} else if args.N.Number == px.impl.np[args.Seq].Number {
-		if args.N.Id == px.impl.np[args.Seq].Id {
-			px.impl.np[args.Seq] = args.N
-			px.impl.na[args.Seq] = args.N
-			px.impl.va[args.Seq] = args.V
+	} else if args.N.Number == np.Number {
+		if args.N.Id == np.Id {
+			px.impl.instances.accept(args.Seq, args.N, args.V)
+			if !px.persist(walRecord{Kind: recAccept, Seq: args.Seq, N: args.N, V: args.V}) {
+				return errKilled
+			}
 			reply.Response = OK
 			reply.Seq = args.Seq
 			reply.N = args.N
 		} else {
-			log.Printf("Proposer %v and Proposer %v both enter accept phase with proposal number %v", px.impl.np[args.Seq].Id, args.N.Id, args.N.Number)
+			log.Printf("Proposer %v and Proposer %v both enter accept phase with proposal number %v", np.Id, args.N.Id, args.N.Number)
 			reply.Response = Reject
 			reply.Seq = args.Seq
 			reply.N = args.N
@@ -113,17 +199,23 @@ func (px *Paxos) Accept(args *AcceptArgs, reply *AcceptReply) error {
 }
 
 func (px *Paxos) Learn(args *DecidedArgs, reply *DecidedReply) error {
+	span := common.StartSpan(args.Trace, px.impl.addr, "Paxos.Learn")
+	defer span.End()
 	px.mu.Lock()
 	defer px.mu.Unlock()
 	// if Seq not in log and Seq is greater than local highest done seq number, succeed
 	if args.Seq > px.impl.localDone {
-		if _, ok := px.impl.instanceLog[args.Seq]; ok {
-			px.impl.instanceLog[args.Seq] = args.V
+		if _, ok := px.impl.instances.decided(args.Seq); ok {
+			px.impl.instances.decide(args.Seq, args.V)
 			reply.Response = OK
 			reply.me = px.me
 			reply.Done = px.impl.localDone
 		} else {
-			px.impl.instanceLog[args.Seq] = args.V
+			px.impl.instances.decide(args.Seq, args.V)
+			px.noteDecided(args.Seq, args.V)
+			if !px.persist(walRecord{Kind: recDecide, Seq: args.Seq, V: args.V}) {
+				return errKilled
+			}
 			reply.Response = OK
 			reply.me = px.me
 			reply.Done = px.impl.localDone
@@ -137,6 +229,67 @@ func (px *Paxos) Learn(args *DecidedArgs, reply *DecidedReply) error {
 	return nil
 }
 
+//
+// multi-paxos prepare: promise args.N for every instance >=
+// args.Seq and report what has been accepted in that range.
+// caller holds px.mu.
+//
+func (px *Paxos) prepareAll(args *PrepareArgs, reply *PrepareReply) error {
+	reply.Seq = args.Seq
+	np, isPromised := px.promised(args.Seq)
+	if px.impl.hasNpAll && px.impl.npAll.Number > np.Number {
+		np = px.impl.npAll
+	}
+	if (isPromised || px.impl.hasNpAll) && args.N.Number <= np.Number {
+		reply.Response = Reject
+		reply.Np = np
+		return nil
+	}
+	if !px.impl.hasNpAll || args.Seq < px.impl.allFrom {
+		// a wider promise than asked for is still safe.
+		px.impl.allFrom = args.Seq
+	}
+	px.impl.hasNpAll = true
+	px.impl.npAll = args.N
+	if !px.persist(walRecord{Kind: recPromiseAll, Seq: px.impl.allFrom, N: args.N}) {
+		return errKilled
+	}
+	if args.N.Id != px.impl.addr {
+		px.impl.leading = false
+	}
+	px.impl.leaderId = args.N.Id
+	reply.Np = args.N
+	reply.Response = EmptyOK
+	if na, va, isInNa := px.impl.instances.accepted(args.Seq); isInNa {
+		reply.Response = OK
+		reply.Na = na
+		reply.Va = va
+	}
+	px.impl.instances.each(args.Seq+1, func(seq int, inst *instance) {
+		if inst.hasNa {
+			reply.Accepted = append(reply.Accepted, AcceptedInstance{Seq: seq, Na: inst.na, Va: inst.va})
+		}
+	})
+	return nil
+}
+
+//
+// a follower hands its Start() value to us, the leader or
+// lease holder.
+//
+func (px *Paxos) Forward(args *ForwardArgs, reply *ForwardReply) error {
+	px.mu.Lock()
+	leading := px.impl.leading || px.leaseValid()
+	px.mu.Unlock()
+	if leading {
+		px.propose(common.WithTrace(context.Background(), args.Trace), args.Seq, args.V)
+		reply.Response = OK
+	} else {
+		reply.Response = Reject
+	}
+	return nil
+}
+
 //
 // add RPC handlers for any RPCs you introduce.
 //
@@ -0,0 +1,86 @@
+package paxos
+
+import (
+	"math/rand"
+)
+
+//
+// application snapshots (see SetSnapshot).
+//
+// once the application has handed its peer a snapshot of its
+// state through instance seq, the peer forgets every instance
+// up to seq that it is Done() with, even if other peers are
+// still behind Min()-wise. such a peer rejects Prepare and
+// Accept for instances it forgot, and a lagging peer that asks
+// it for them (see catchUp) forgets them too; its application
+// then finds them Forgotten and installs a snapshot fetched
+// from a peer with FetchSnapshot().
+//
+
+type SnapshotArgs struct {
+	Min int // the lowest seq the caller can use
+}
+
+type SnapshotReply struct {
+	Ok   bool
+	Seq  int // the snapshot covers every instance <= Seq
+	Data []byte
+}
+
+//
+// the application's state, with every instance <= seq applied.
+// data must not be modified afterwards.
+//
+func (px *Paxos) SetSnapshot(seq int, data []byte) {
+	px.mu.Lock()
+	if seq > px.impl.snapSeq {
+		px.impl.snapSeq = seq
+		px.impl.snapData = data
+	}
+	px.mu.Unlock()
+	px.Forget()
+}
+
+//
+// the instances the snapshot lets this peer forget: those it
+// covers and the application is done with. caller holds px.mu.
+//
+func (px *Paxos) snapshotThrough() int {
+	if px.impl.snapSeq < px.impl.localDone {
+		return px.impl.snapSeq
+	}
+	return px.impl.localDone
+}
+
+func (px *Paxos) Snapshot(args *SnapshotArgs, reply *SnapshotReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if px.impl.snapData != nil && px.impl.snapSeq >= args.Min {
+		reply.Ok = true
+		reply.Seq = px.impl.snapSeq
+		reply.Data = px.impl.snapData
+	}
+	return nil
+}
+
+//
+// ask the other members, in random order, for a snapshot that
+// covers seq min. returns the first one found.
+//
+func (px *Paxos) FetchSnapshot(min int) (int, []byte, bool) {
+	px.mu.Lock()
+	var others []string
+	for _, idx := range px.impl.epochs[len(px.impl.epochs)-1].Members {
+		if idx != px.me {
+			others = append(others, px.peers[idx])
+		}
+	}
+	px.mu.Unlock()
+	for _, i := range rand.Perm(len(others)) {
+		var reply SnapshotReply
+		if px.call(others[i], "Paxos.Snapshot", &SnapshotArgs{Min: min}, &reply) && reply.Ok {
+			return reply.Seq, reply.Data, true
+		}
+	}
+	return -1, nil, false
+}
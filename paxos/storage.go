@@ -0,0 +1,185 @@
+package paxos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+//
+// write-ahead log for acceptor state.
+//
+// every record is framed as a 4-byte length, a 4-byte crc32
+// of the payload and the gob-encoded payload itself. each
+// payload is encoded on its own, so the file can be appended
+// to across restarts. a torn or corrupt frame at the tail
+// (a crash in the middle of a write) ends the replay and is
+// cut off before new records are appended.
+//
+
+const (
+	walFile         = "paxos.wal"
+	walCompactAfter = 1000 // appended records before the log is rewritten
+)
+
+const (
+	recPromise    = iota + 1 // np[Seq] = N
+	recAccept                // np[Seq] = na[Seq] = N, va[Seq] = V
+	recDecide                // Seq decided with value V
+	recDone                  // localDone = Seq
+	recPromiseAll            // npAll = N for every instance >= Seq
+	recReconfig              // V is the Reconfig decided for Seq
+	recForget                // every instance < Seq is forgotten
+)
+
+type walRecord struct {
+	Kind int
+	Seq  int
+	N    ProposalNumber
+	V    interface{}
+}
+
+type storage struct {
+	dir      string
+	f        *os.File
+	appended int // records appended since the last compaction
+}
+
+//
+// open (or create) the log under dir and return all of
+// the intact records found in it, oldest first.
+//
+func openStorage(dir string) (*storage, []walRecord, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, nil, err
+	}
+	path := filepath.Join(dir, walFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+	var recs []walRecord
+	var good int64
+	for {
+		rec, size, err := readRecord(f)
+		if err != nil {
+			break
+		}
+		recs = append(recs, rec)
+		good += size
+	}
+	// drop whatever follows the last intact record.
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return &storage{dir: dir, f: f}, recs, nil
+}
+
+func readRecord(r io.Reader) (walRecord, int64, error) {
+	var rec walRecord
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return rec, 0, err
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return rec, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return rec, 0, io.ErrUnexpectedEOF
+	}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&rec); err != nil {
+		return rec, 0, err
+	}
+	return rec, int64(len(header)) + int64(size), nil
+}
+
+func encodeRecord(buf *bytes.Buffer, rec walRecord) error {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(&rec); err != nil {
+		return err
+	}
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+	buf.Write(header[:])
+	buf.Write(payload.Bytes())
+	return nil
+}
+
+//
+// append recs to the log and fsync before returning.
+//
+func (st *storage) append(recs ...walRecord) error {
+	var buf bytes.Buffer
+	for _, rec := range recs {
+		if err := encodeRecord(&buf, rec); err != nil {
+			return err
+		}
+	}
+	if _, err := st.f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	st.appended += len(recs)
+	return st.f.Sync()
+}
+
+func (st *storage) needsCompaction() bool {
+	return st.appended >= walCompactAfter
+}
+
+//
+// replace the whole log with recs, which must describe
+// the complete current state. the new log is written to
+// a temporary file and renamed over the old one, so a
+// crash leaves either the old or the new log in place.
+//
+func (st *storage) compact(recs []walRecord) error {
+	var buf bytes.Buffer
+	for _, rec := range recs {
+		if err := encodeRecord(&buf, rec); err != nil {
+			return err
+		}
+	}
+	path := filepath.Join(st.dir, walFile)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		f.Close()
+		return err
+	}
+	if d, err := os.Open(st.dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	st.f.Close()
+	st.f = f
+	st.appended = 0
+	return nil
+}
+
+func (st *storage) close() {
+	st.f.Close()
+}
@@ -0,0 +1,219 @@
+package paxos
+
+import (
+	"io/ioutil"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//
+// a single peer on dir that does not listen: the tests call
+// its handlers directly.
+//
+func makeStored(tag string, dir string) *Paxos {
+	return Make([]string{port(tag, 0)}, 0, rpc.NewServer(), WithStorage(dir))
+}
+
+func storageDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "paxos-wal")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+//
+// promise seq 0 to (5, a), accept (3, a, "a") for seq 1 and
+// decide "b" for seq 2.
+//
+func fillStored(t *testing.T, px *Paxos) {
+	var preply PrepareReply
+	px.Prepare(&PrepareArgs{Seq: 0, N: ProposalNumber{5, "a"}, Done: InitDone}, &preply)
+	if preply.Response == Reject {
+		t.Fatalf("Prepare(0) rejected")
+	}
+	var areply AcceptReply
+	px.Accept(&AcceptArgs{Seq: 1, N: ProposalNumber{3, "a"}, V: "a", Done: InitDone}, &areply)
+	if areply.Response != OK {
+		t.Fatalf("Accept(1) got %v", areply.Response)
+	}
+	if !px.LocalLearn(2, "b") {
+		t.Fatalf("LocalLearn(2) failed")
+	}
+}
+
+//
+// check that px has the state fillStored() gave its predecessor.
+// probe, above 5, is the proposal number to look at seq 1 with.
+//
+func checkStored(t *testing.T, px *Paxos, probe int) {
+	var preply PrepareReply
+	px.Prepare(&PrepareArgs{Seq: 0, N: ProposalNumber{4, "b"}, Done: InitDone}, &preply)
+	if preply.Response != Reject {
+		t.Fatalf("promise for seq 0 was lost: Prepare(4) got %v", preply.Response)
+	}
+	preply = PrepareReply{}
+	px.Prepare(&PrepareArgs{Seq: 1, N: ProposalNumber{probe, "b"}, Done: InitDone}, &preply)
+	if preply.Response != OK || preply.Na != (ProposalNumber{3, "a"}) || preply.Va != "a" {
+		t.Fatalf("accepted value for seq 1 was lost: got %v %v %v", preply.Response, preply.Na, preply.Va)
+	}
+	if fate, v := px.Status(2); fate != Decided || v != "b" {
+		t.Fatalf("decision for seq 2 was lost: got %v %v", fate, v)
+	}
+}
+
+func TestStorageRestart(t *testing.T) {
+	dir, remove := storageDir(t)
+	defer remove()
+
+	px := makeStored("restart", dir)
+	fillStored(t, px)
+	px.Kill()
+
+	px = makeStored("restart", dir)
+	defer px.Kill()
+	checkStored(t, px, 7)
+}
+
+func TestStorageTornTail(t *testing.T) {
+	dir, remove := storageDir(t)
+	defer remove()
+
+	px := makeStored("torn", dir)
+	fillStored(t, px)
+	px.Kill()
+
+	// a crash in the middle of writing a record: a header that
+	// promises more than follows, behind a record whose
+	// checksum no longer matches.
+	f, err := os.OpenFile(filepath.Join(dir, walFile), os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+	f.Write([]byte{0, 0, 0, 4, 1, 2, 3, 4, 'x', 'x', 'x', 'x'})
+	f.Write([]byte{0, 0, 1, 0, 0, 0, 0, 0, 'y'})
+	f.Close()
+
+	px = makeStored("torn", dir)
+	checkStored(t, px, 7)
+	// records written after the cut must survive the next restart.
+	if !px.LocalLearn(3, "c") {
+		t.Fatalf("LocalLearn(3) failed")
+	}
+	px.Kill()
+
+	px = makeStored("torn", dir)
+	defer px.Kill()
+	checkStored(t, px, 8)
+	if fate, v := px.Status(3); fate != Decided || v != "c" {
+		t.Fatalf("decision written after the torn tail was lost: got %v %v", fate, v)
+	}
+}
+
+func TestStorageForgotten(t *testing.T) {
+	dir, remove := storageDir(t)
+	defer remove()
+
+	px := makeStored("forget", dir)
+	for seq := 0; seq < 10; seq++ {
+		px.LocalLearn(seq, seq)
+	}
+	px.Done(4)
+	px.Kill()
+
+	px = makeStored("forget", dir)
+	defer px.Kill()
+	for seq := 0; seq < 10; seq++ {
+		fate, v := px.Status(seq)
+		if seq <= 4 && fate != Forgotten {
+			t.Fatalf("forgotten seq %v came back as %v", seq, fate)
+		}
+		if seq > 4 && (fate != Decided || v != seq) {
+			t.Fatalf("seq %v: got %v %v", seq, fate, v)
+		}
+	}
+}
+
+func logSize(t *testing.T, dir string) int64 {
+	info, err := os.Stat(filepath.Join(dir, walFile))
+	if err != nil {
+		t.Fatalf("stat log: %v", err)
+	}
+	return info.Size()
+}
+
+func TestStorageCompaction(t *testing.T) {
+	dir, remove := storageDir(t)
+	defer remove()
+
+	px := makeStored("compact", dir)
+	n := walCompactAfter + 100
+	for seq := 0; seq < n; seq++ {
+		px.LocalLearn(seq, seq)
+	}
+	before := logSize(t, dir)
+	px.Done(n / 2)
+	// a background Forget() may have compacted the log already,
+	// before the instances above were forgotten; do it again.
+	px.mu.Lock()
+	px.impl.storage.appended = walCompactAfter
+	px.compactStorage()
+	px.mu.Unlock()
+	if after := logSize(t, dir); after >= before {
+		t.Fatalf("log was not compacted: %v bytes before, %v after", before, after)
+	}
+	var areply AcceptReply
+	px.Accept(&AcceptArgs{Seq: n, N: ProposalNumber{3, "a"}, V: "a", Done: InitDone}, &areply)
+	if areply.Response != OK {
+		t.Fatalf("Accept(%v) got %v", n, areply.Response)
+	}
+	px.Kill()
+
+	px = makeStored("compact", dir)
+	defer px.Kill()
+	if fate, _ := px.Status(n / 2); fate != Forgotten {
+		t.Fatalf("seq %v: got %v after compaction, wanted Forgotten", n/2, fate)
+	}
+	for seq := n/2 + 1; seq < n; seq++ {
+		if fate, v := px.Status(seq); fate != Decided || v != seq {
+			t.Fatalf("seq %v: got %v %v after compaction", seq, fate, v)
+		}
+	}
+	var preply PrepareReply
+	px.Prepare(&PrepareArgs{Seq: n, N: ProposalNumber{7, "b"}, Done: InitDone}, &preply)
+	if preply.Na != (ProposalNumber{3, "a"}) || preply.Va != "a" {
+		t.Fatalf("accept after compaction was lost: got %v %v", preply.Na, preply.Va)
+	}
+}
+
+func TestStorageReconfigForgotten(t *testing.T) {
+	dir, remove := storageDir(t)
+	defer remove()
+
+	// the second peer never starts; the first removes it, and
+	// forgets the RemovePeer once past it.
+	pxh := []string{port("reconfigwal", 0), port("reconfigwal", 1)}
+	start := func() *Paxos {
+		return Make(pxh, 0, rpc.NewServer(), WithStorage(dir), WithReconfig())
+	}
+	px := start()
+	px.LocalLearn(0, RemovePeer(pxh[1]))
+	for seq := 1; seq <= Alpha+2; seq++ {
+		px.LocalLearn(seq, seq)
+	}
+	px.Done(Alpha + 1)
+	if fate, _ := px.Status(0); fate != Forgotten {
+		t.Fatalf("the RemovePeer is %v, not forgotten", fate)
+	}
+	checkMembers(t, []*Paxos{px}, pxh[:1])
+	px.Kill()
+
+	px = start()
+	defer px.Kill()
+	if fate, _ := px.Status(0); fate != Forgotten {
+		t.Fatalf("the RemovePeer came back as %v", fate)
+	}
+	checkMembers(t, []*Paxos{px}, pxh[:1])
+}
@@ -0,0 +1,22 @@
+package paxosrsm
+
+//
+// optional settings for MakeRSM().
+//
+type Option func(rsm *PaxosRSM)
+
+//
+// let the RSM snapshot the application's state: snapshot()
+// returns it, with every value applied so far, and restore()
+// replaces it. the RSM takes a snapshot every SnapshotEvery
+// instances and hands it to Paxos (see paxos.SetSnapshot), so
+// that Paxos can forget the instances it covers; a replica
+// that falls behind them, or joins later, restores a peer's
+// snapshot instead of applying them.
+//
+func WithSnapshots(snapshot func() []byte, restore func([]byte)) Option {
+	return func(rsm *PaxosRSM) {
+		rsm.impl.snapshot = snapshot
+		rsm.impl.restore = restore
+	}
+}
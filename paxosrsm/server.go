@@ -1,11 +1,14 @@
 package paxosrsm
 
 import (
+	"sync/atomic"
+
 	"umich.edu/eecs491/proj5/paxos"
 )
 
 type PaxosRSM struct {
 	me      int
+	dead    int32 // for testing
 	px      *paxos.Paxos
 	applyOp func (interface{})
 	equals func (interface{}, interface{}) bool
@@ -13,7 +16,13 @@ type PaxosRSM struct {
 }
 
 func (rsm *PaxosRSM) Kill() {
+	atomic.StoreInt32(&rsm.dead, 1)
 	rsm.px.Kill()
+	rsm.killImpl()
+}
+
+func (rsm *PaxosRSM) isdead() bool {
+	return atomic.LoadInt32(&rsm.dead) != 0
 }
 
 //
@@ -22,8 +31,9 @@ func (rsm *PaxosRSM) Kill() {
 // its state
 // equals(v1, v2) helps the RSM compare two values and determine if they are
 // identical
+// opts are optional settings, e.g. WithSnapshots(snapshot, restore).
 //
-func MakeRSM(me int, px *paxos.Paxos, applyOp func (interface{}), equals func (interface{}, interface{}) bool) *PaxosRSM {
+func MakeRSM(me int, px *paxos.Paxos, applyOp func (interface{}), equals func (interface{}, interface{}) bool, opts ...Option) *PaxosRSM {
 	rsm := new(PaxosRSM)
 
 	rsm.me = me
@@ -32,6 +42,10 @@ func MakeRSM(me int, px *paxos.Paxos, applyOp func (interface{}), equals func (i
 	rsm.equals = equals
 
 	rsm.InitRSMImpl()
+	for _, opt := range opts {
+		opt(rsm)
+	}
+	go rsm.applyLoop()
 
 	return rsm
 }
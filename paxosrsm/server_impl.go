@@ -1,18 +1,84 @@
 package paxosrsm
 
 import (
+	"context"
+	"encoding/gob"
+	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"umich.edu/eecs491/proj5/common"
 	"umich.edu/eecs491/proj5/paxos"
 )
 
+//
+// a background goroutine (applyLoop) applies decided instances
+// in order as this peer learns of them, whether or not it has
+// clients, and tells Paxos it is Done with each.
+//
+// batching and pipelining: StartOp() queues a value, and up to
+// MaxInflight proposer goroutines take everything queued (up to
+// MaxBatch values, after waiting BatchWindow for more to arrive)
+// and agree on it as one Batch in a single Paxos instance, each
+// in an instance of its own, so that a slow round only holds up
+// the values in its batch. applyOp still sees the values one at
+// a time, in batch order. Reconfig values go through Paxos on
+// their own, since Paxos has to see them to change the
+// membership.
+//
+
+const (
+	BatchWindow   = 2 * time.Millisecond
+	MaxBatch      = 64
+	MaxInflight   = 4   // batches being agreed on at once
+	SnapshotEvery = 100 // instances between snapshots (see WithSnapshots)
+)
+
+//
+// AddOpContext() returns ErrKilled if the RSM is killed before
+// the value is applied.
+//
+var ErrKilled = errors.New("paxosrsm: killed")
+
+type Batch struct {
+	Values []interface{}
+}
+
+func init() {
+	gob.Register(Batch{})
+}
+
+//
+// a value waiting to be decided; done is closed once it has
+// been applied.
+//
+type pending struct {
+	v         interface{}
+	done      chan bool
+	span      *common.Span // of the StartOp() that queued v
+	cancelled int32        // atomic; set once AddOpContext gives up
+}
+
 //
 // additions to PaxosRSM state
 //
 type PaxosRSMImpl struct {
-	mu  sync.Mutex
-	seq int
+	mu       sync.Mutex        // held while applying
+	advanced *sync.Cond        // on mu; broadcast whenever seq moves
+	seq      int               // the next instance to apply
+	next     int               // the next instance for a proposer to take
+	inflight map[*pending]bool // in the batches being proposed
+	// values queued by StartOp, not yet taken into a batch
+	qmu       sync.Mutex
+	queue     []*pending
+	proposers int // running, at most MaxInflight
+	// see WithSnapshots; applied counts instances since the last snapshot
+	snapshot func() []byte
+	restore  func([]byte)
+	applied  int
+	killed   chan bool // closed by Kill
+	kill     sync.Once
 }
 
 //
@@ -20,43 +86,389 @@ type PaxosRSMImpl struct {
 //
 func (rsm *PaxosRSM) InitRSMImpl() {
 	rsm.impl.seq = 0
+	rsm.impl.advanced = sync.NewCond(&rsm.impl.mu)
+	rsm.impl.inflight = make(map[*pending]bool)
+	rsm.impl.killed = make(chan bool)
+}
+
+//
+// stop the proposers, and wake up the AddOpContext() callers.
+//
+func (rsm *PaxosRSM) killImpl() {
+	rsm.impl.kill.Do(func() {
+		close(rsm.impl.killed)
+		// an applyOp may hold mu for as long as it likes.
+		go func() {
+			rsm.impl.mu.Lock()
+			defer rsm.impl.mu.Unlock()
+			rsm.impl.advanced.Broadcast()
+		}()
+	})
 }
 
 //
 // application invokes AddOp to submit a new operation to the replicated log
 // AddOp returns only once value v has been decided for some Paxos instance
+// and applied
 //
 func (rsm *PaxosRSM) AddOp(v interface{}) {
+	<-rsm.StartOp(v)
+}
+
+//
+// like AddOp, but give up once ctx is done or the RSM is killed,
+// returning ctx.Err() or ErrKilled. v is not proposed for any
+// instance after that, but if a proposer had taken it, it may
+// still be decided for the instance it was already proposed for,
+// and applied; the application has to recognize it if it submits
+// v again.
+//
+func (rsm *PaxosRSM) AddOpContext(ctx context.Context, v interface{}) error {
+	span := common.StartSpan(common.TraceOf(v), rsm.px.Port(), "PaxosRSM.AddOp")
+	p := rsm.start(v, span)
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		rsm.cancel(p)
+		return ctx.Err()
+	case <-rsm.impl.killed:
+		rsm.cancel(p)
+		return ErrKilled
+	}
+}
+
+//
+// submit v like AddOp, without waiting: the channel returned is
+// closed once v has been decided and applied.
+//
+func (rsm *PaxosRSM) StartOp(v interface{}) <-chan bool {
+	span := common.StartSpan(common.TraceOf(v), rsm.px.Port(), "PaxosRSM.AddOp")
+	return rsm.start(v, span).done
+}
+
+func (rsm *PaxosRSM) start(v interface{}, span *common.Span) *pending {
+	p := &pending{v: v, done: make(chan bool), span: span}
+	rsm.impl.qmu.Lock()
+	defer rsm.impl.qmu.Unlock()
+	rsm.impl.queue = append(rsm.impl.queue, p)
+	if rsm.impl.proposers < MaxInflight {
+		rsm.impl.proposers += 1
+		go rsm.proposer()
+	}
+	return p
+}
+
+//
+// take p off the queue, if no proposer has taken it yet;
+// otherwise keep its proposer from proposing it again, and
+// its span ends once it is applied or dropped.
+//
+func (rsm *PaxosRSM) cancel(p *pending) {
+	rsm.impl.qmu.Lock()
+	defer rsm.impl.qmu.Unlock()
+	atomic.StoreInt32(&p.cancelled, 1)
+	for i, q := range rsm.impl.queue {
+		if q == p {
+			rsm.impl.queue = append(rsm.impl.queue[:i:i], rsm.impl.queue[i+1:]...)
+			p.span.End()
+			return
+		}
+	}
+}
+
+//
+// propose batches off the queue until it is empty.
+//
+func (rsm *PaxosRSM) proposer() {
+	for !rsm.isdead() {
+		time.Sleep(BatchWindow)
+		batch := rsm.takeBatch()
+		if len(batch) == 0 {
+			return
+		}
+		rsm.propose(batch)
+	}
+}
+
+func isDone(p *pending) bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+//
+// applied, or given up on by its AddOpContext().
+//
+func isSettled(p *pending) bool {
+	return isDone(p) || atomic.LoadInt32(&p.cancelled) != 0
+}
+
+//
+// take the next batch off the queue: a Reconfig alone, or up
+// to MaxBatch other values. the proposer calling it stops if
+// there is none.
+//
+func (rsm *PaxosRSM) takeBatch() []*pending {
+	rsm.impl.qmu.Lock()
+	defer rsm.impl.qmu.Unlock()
+	if len(rsm.impl.queue) == 0 {
+		rsm.impl.proposers -= 1
+		return nil
+	}
+	n := 0
+	for n < len(rsm.impl.queue) && n < MaxBatch {
+		if _, isReconfig := rsm.impl.queue[n].v.(paxos.Reconfig); isReconfig {
+			if n == 0 {
+				n = 1
+			}
+			break
+		}
+		n += 1
+	}
+	batch := rsm.impl.queue[:n:n]
+	rsm.impl.queue = rsm.impl.queue[n:]
+	return batch
+}
+
+//
+// agree on batch, proposing it for one instance after another
+// until applyLoop has applied all of it, or the RSM is killed.
+// the other proposers take other instances meanwhile. a value
+// cancelled by AddOpContext() is left out from the next instance
+// on; the instance it was proposed for still has to be decided,
+// with it or not, or applyLoop would wait on it forever.
+//
+func (rsm *PaxosRSM) propose(batch []*pending) {
+	// the Paxos messages carry the trace of one of the values.
+	ctx := context.Background()
+	for _, p := range batch {
+		if tc := p.span.Context(); tc.Valid() {
+			ctx = common.WithTrace(ctx, tc)
+			break
+		}
+	}
 	rsm.impl.mu.Lock()
 	defer rsm.impl.mu.Unlock()
-	for {
-		rsm.px.Start(rsm.impl.seq, v)
-		to := 10 * time.Millisecond
-		for {
-			time.Sleep(to)
-			if to < 10*time.Second {
-				to *= 2
-			}
-			//log.Printf("2.5 start on %v", rsm.impl.seq)
-			status, value := rsm.px.Status(rsm.impl.seq)
-			//log.Printf("2.5 start finishes on %v with status %v value %v", rsm.impl.seq, status, value)
-			if status == paxos.Pending {
-				continue
-			} else if status == paxos.Forgotten {
-				//log.Printf("----------------------Should never get here------------------------")
-				rsm.impl.seq += 1
-			} else {
-				//log.Printf("2 seq %v value %v", rsm.impl.seq, value)
-				//log.Printf("2 seq %v v %v", rsm.impl.seq, v)
-				rsm.applyOp(value)
-				rsm.impl.seq += 1
-				if rsm.equals(v, value) {
-					rsm.px.Done(rsm.impl.seq - 1)
-					return
-				} else {
-					break
-				}
+	for _, p := range batch {
+		rsm.impl.inflight[p] = true
+	}
+	for !allSettled(batch) && !rsm.isdead() {
+		if rsm.impl.next < rsm.impl.seq {
+			rsm.impl.next = rsm.impl.seq
+		}
+		seq := rsm.impl.next
+		rsm.impl.next += 1
+		v := proposalFor(batch)
+		rsm.impl.mu.Unlock()
+		rsm.px.StartContext(ctx, seq, v)
+		rsm.impl.mu.Lock()
+		for rsm.impl.seq <= seq && !rsm.isdead() {
+			rsm.impl.advanced.Wait()
+		}
+	}
+	// the cancelled values no one will propose again.
+	for _, p := range batch {
+		if rsm.impl.inflight[p] && !isDone(p) && !rsm.isdead() {
+			delete(rsm.impl.inflight, p)
+			p.span.End()
+		}
+	}
+}
+
+func (rsm *PaxosRSM) applyLoop() {
+	for !rsm.isdead() {
+		rsm.impl.mu.Lock()
+		seq := rsm.impl.seq
+		rsm.impl.mu.Unlock()
+		// wakes up as soon as this peer learns the decision.
+		<-rsm.px.Notify(seq)
+		rsm.impl.mu.Lock()
+		status, value := rsm.px.Status(seq)
+		if rsm.impl.seq != seq {
+			// LocalRead got there first.
+		} else if status == paxos.Decided {
+			rsm.applyNext(value)
+		} else if status == paxos.Forgotten {
+			// behind the other peers' snapshots.
+			rsm.skipForgotten()
+		}
+		rsm.impl.mu.Unlock()
+		if status == paxos.Pending {
+			// only a killed peer gives up without a decision.
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+//
+// apply value, decided for instance rsm.impl.seq, and move on
+// to the next one. caller holds rsm.impl.mu.
+//
+func (rsm *PaxosRSM) applyNext(value interface{}) {
+	rsm.apply(value)
+	rsm.impl.seq += 1
+	if rsm.impl.snapshot == nil {
+		rsm.px.Done(rsm.impl.seq - 1)
+	}
+	rsm.maybeSnapshot()
+	rsm.impl.advanced.Broadcast()
+}
+
+//
+// apply a decided value (or each value of a decided Batch),
+// marking the values in flight it contains as done. caller
+// holds rsm.impl.mu.
+//
+func (rsm *PaxosRSM) apply(value interface{}) {
+	values := []interface{}{value}
+	if b, isBatch := value.(Batch); isBatch {
+		values = b.Values
+	}
+	for _, value := range values {
+		if _, isReconfig := value.(paxos.Reconfig); !isReconfig {
+			span := common.StartSpan(common.TraceOf(value), rsm.px.Port(), "ApplyOp")
+			rsm.applyOp(value)
+			span.End()
+		}
+		for p := range rsm.impl.inflight {
+			if rsm.same(p.v, value) {
+				delete(rsm.impl.inflight, p)
+				p.span.End()
+				close(p.done)
 			}
 		}
 	}
 }
+
+//
+// the values of batch not decided or cancelled yet, as one
+// value to agree on.
+//
+func proposalFor(batch []*pending) interface{} {
+	b := Batch{}
+	for _, p := range batch {
+		if !isSettled(p) {
+			b.Values = append(b.Values, p.v)
+		}
+	}
+	if len(b.Values) == 1 {
+		return b.Values[0]
+	}
+	return b
+}
+
+func allSettled(batch []*pending) bool {
+	for _, p := range batch {
+		if !isSettled(p) {
+			return false
+		}
+	}
+	return true
+}
+
+//
+// compare an op with a decided value; Reconfig values are
+// Paxos' own, so the application's equals never sees them.
+//
+func (rsm *PaxosRSM) same(v interface{}, value interface{}) bool {
+	_, isReconfig1 := v.(paxos.Reconfig)
+	_, isReconfig2 := value.(paxos.Reconfig)
+	if isReconfig1 || isReconfig2 {
+		return v == value
+	}
+	return rsm.equals(v, value)
+}
+
+//
+// agree through the log to add the Paxos peer at port to the
+// group (the Paxos peers need WithReconfig). returns once the
+// change is decided; it takes effect paxos.Alpha instances later.
+//
+func (rsm *PaxosRSM) AddPeer(port string) {
+	rsm.AddOp(paxos.AddPeer(port))
+}
+
+//
+// agree through the log to remove the Paxos peer at port.
+//
+func (rsm *PaxosRSM) RemovePeer(port string) {
+	rsm.AddOp(paxos.RemovePeer(port))
+}
+
+//
+// run read against the application's state without agreeing on
+// it first, if this peer holds the Paxos lease (the peers need
+// paxos.WithLeases) and every instance the lease covers has been
+// decided here; they are applied first. returns false, without
+// calling read, otherwise: the caller then has to go through
+// AddOp().
+//
+func (rsm *PaxosRSM) LocalRead(read func()) bool {
+	rsm.impl.mu.Lock()
+	defer rsm.impl.mu.Unlock()
+	through, ok := rsm.px.HoldsLease()
+	if !ok {
+		return false
+	}
+	for rsm.impl.seq <= through {
+		status, value := rsm.px.Status(rsm.impl.seq)
+		if status != paxos.Decided {
+			return false
+		}
+		rsm.applyNext(value)
+	}
+	// the lease must outlast the catching up.
+	if _, ok := rsm.px.HoldsLease(); !ok {
+		return false
+	}
+	read()
+	return true
+}
+
+//
+// take a snapshot if SnapshotEvery instances have been applied
+// since the last one. only then is this replica Done() with
+// them, so that whatever the group forgets, every replica has a
+// snapshot for. caller holds rsm.impl.mu.
+//
+func (rsm *PaxosRSM) maybeSnapshot() {
+	if rsm.impl.snapshot == nil {
+		return
+	}
+	rsm.impl.applied += 1
+	if rsm.impl.applied >= SnapshotEvery {
+		rsm.impl.applied = 0
+		rsm.px.SetSnapshot(rsm.impl.seq-1, rsm.impl.snapshot())
+		rsm.px.Done(rsm.impl.seq - 1)
+	}
+}
+
+//
+// rsm.impl.seq has been forgotten before this replica applied
+// it: restore a snapshot that covers it, from another replica.
+// without snapshots, all there is to do is to move on. caller
+// holds rsm.impl.mu.
+//
+func (rsm *PaxosRSM) skipForgotten() {
+	defer rsm.impl.advanced.Broadcast()
+	if rsm.impl.restore == nil {
+		rsm.impl.seq += 1
+		return
+	}
+	for !rsm.isdead() {
+		seq, data, ok := rsm.px.FetchSnapshot(rsm.impl.seq)
+		if ok {
+			rsm.impl.restore(data)
+			rsm.impl.seq = seq + 1
+			rsm.impl.applied = 0
+			rsm.px.SetSnapshot(seq, data)
+			rsm.px.Done(seq)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
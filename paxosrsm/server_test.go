@@ -0,0 +1,117 @@
+package paxosrsm
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"umich.edu/eecs491/proj5/common"
+	"umich.edu/eecs491/proj5/paxos"
+)
+
+func port(tag string, host int) string {
+	s := "/var/tmp/824-"
+	s += strconv.Itoa(os.Getuid()) + "/"
+	os.Mkdir(s, 0777)
+	s += "rsm-"
+	s += strconv.Itoa(os.Getpid()) + "-"
+	s += tag + "-"
+	s += strconv.Itoa(host)
+	return s
+}
+
+//
+// the values an RSM has applied, in order.
+//
+type log struct {
+	mu     sync.Mutex
+	values []interface{}
+}
+
+func (l *log) apply(v interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.values = append(l.values, v)
+}
+
+func (l *log) has(v interface{}) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, x := range l.values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func equals(v1 interface{}, v2 interface{}) bool {
+	return v1 == v2
+}
+
+func TestCancelledOp(t *testing.T) {
+	pc := common.NewPartitionController(common.DefaultTransport)
+	old := common.SetTransport(pc)
+	defer common.SetTransport(old)
+
+	const npaxos = 3
+	pxh := make([]string, npaxos)
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("cancel", i)
+	}
+	pxa := make([]*paxos.Paxos, npaxos)
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = paxos.Make(pxh, i, nil)
+	}
+	logs := make([]*log, 2)
+	rsms := make([]*PaxosRSM, 2)
+	for i := range rsms {
+		logs[i] = &log{}
+		rsms[i] = MakeRSM(i, pxa[i], logs[i].apply, equals)
+	}
+	defer func() {
+		for _, rsm := range rsms {
+			rsm.Kill()
+		}
+		for _, px := range pxa {
+			px.Kill()
+		}
+	}()
+
+	// peer 0 cannot reach a majority, so "a" times out while
+	// being proposed for instance 0, which the others decide
+	// with "b".
+	id := pc.Isolate([]string{pxh[0]}, []string{common.AnyEndpoint})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := rsms[0].AddOpContext(ctx, "a"); err != context.DeadlineExceeded {
+		t.Fatalf("AddOpContext with no majority returned %v", err)
+	}
+	rsms[1].AddOp("b")
+	pc.Remove(id)
+
+	// once peer 0 learns instance 0, it does not propose "a"
+	// for any later one.
+	rsms[1].AddOp("c")
+	for iters := 0; iters < 50 && !logs[0].has("c"); iters++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !logs[0].has("c") {
+		t.Fatalf("peer 0 did not apply c")
+	}
+	rsms[1].AddOp("d")
+	for i, l := range logs {
+		if l.has("a") {
+			t.Fatalf("peer %v applied a cancelled value: %v", i, l.values)
+		}
+	}
+	rsms[0].impl.mu.Lock()
+	n := len(rsms[0].impl.inflight)
+	rsms[0].impl.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("%v values still in flight", n)
+	}
+}
@@ -27,6 +27,8 @@ func (ck *Clerk) InitImpl() {
 func (ck *Clerk) Get(key string) string {
 	ck.mu.Lock()
 	defer ck.mu.Unlock()
+	span := common.NewTrace("clerk", "Clerk.Get")
+	defer span.End()
 	requestId := int(common.Nrand())
 	for {
 		config := ck.sm.Query(-1)
@@ -37,6 +39,7 @@ func (ck *Clerk) Get(key string) string {
 			Impl: GetArgsImpl{
 				RequestId: requestId,
 				ConfigNum: config.Num,
+				Trace:     span.Context(),
 			},
 		}
 		var reply GetReply
@@ -62,6 +65,8 @@ func (ck *Clerk) Get(key string) string {
 func (ck *Clerk) PutAppend(key string, value string, op string) {
 	ck.mu.Lock()
 	defer ck.mu.Unlock()
+	span := common.NewTrace("clerk", "Clerk."+op)
+	defer span.End()
 	requestId := int(common.Nrand())
 	for {
 		config := ck.sm.Query(-1)
@@ -74,6 +79,7 @@ func (ck *Clerk) PutAppend(key string, value string, op string) {
 			Impl: PutAppendArgsImpl{
 				RequestId: requestId,
 				ConfigNum: config.Num,
+				Trace:     span.Context(),
 			},
 		}
 		var reply PutAppendReply
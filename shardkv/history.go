@@ -0,0 +1,103 @@
+package shardkv
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"umich.edu/eecs491/proj5/linearizability"
+)
+
+// how long Check() may take before it fails the history.
+const CheckTimeout = 20 * time.Second
+
+//
+// a Recorder keeps the history of every Get, Put and Append
+// made through its RecordingClerks, with invocation and
+// response times, for linearizability.CheckOperations().
+//
+type Recorder struct {
+	mu      sync.Mutex
+	start   time.Time
+	clients int
+	ops     []linearizability.Operation
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{start: time.Now()}
+}
+
+//
+// a Clerk whose calls are recorded as one client's.
+//
+type RecordingClerk struct {
+	ck *Clerk
+	r  *Recorder
+	id int
+}
+
+func (r *Recorder) Clerk(ck *Clerk) *RecordingClerk {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clients++
+	return &RecordingClerk{ck: ck, r: r, id: r.clients}
+}
+
+func (r *Recorder) now() int64 {
+	return int64(time.Since(r.start))
+}
+
+func (r *Recorder) record(id int, in linearizability.KvInput, call int64, out string) {
+	ret := r.now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ops = append(r.ops, linearizability.Operation{
+		ClientId: id, Input: in, Call: call, Output: out, Return: ret,
+	})
+}
+
+//
+// the operations that have completed so far.
+//
+func (r *Recorder) History() []linearizability.Operation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ops := make([]linearizability.Operation, len(r.ops))
+	copy(ops, r.ops)
+	return ops
+}
+
+//
+// check the history against the key/value model; on failure,
+// also return a counter-example. a check that takes longer
+// than CheckTimeout fails too: keep histories small enough.
+//
+func (r *Recorder) Check() (bool, string) {
+	result, info := linearizability.CheckOperationsTimeout(linearizability.KvModel, r.History(), CheckTimeout)
+	switch result {
+	case linearizability.Illegal:
+		return false, info.Describe(linearizability.KvModel)
+	case linearizability.Unknown:
+		return false, fmt.Sprintf("linearizability check gave up after %v", CheckTimeout)
+	}
+	return true, ""
+}
+
+func (rc *RecordingClerk) Get(key string) string {
+	call := rc.r.now()
+	v := rc.ck.Get(key)
+	rc.r.record(rc.id, linearizability.KvInput{Op: linearizability.GetOp, Key: key}, call, v)
+	return v
+}
+
+func (rc *RecordingClerk) Put(key string, value string) {
+	call := rc.r.now()
+	rc.ck.Put(key, value)
+	rc.r.record(rc.id, linearizability.KvInput{Op: linearizability.PutOp, Key: key, Value: value}, call, "")
+}
+
+func (rc *RecordingClerk) Append(key string, value string) {
+	call := rc.r.now()
+	rc.ck.Append(key, value)
+	rc.r.record(rc.id, linearizability.KvInput{Op: linearizability.AppendOp, Key: key, Value: value}, call, "")
+}
@@ -0,0 +1,51 @@
+package shardkv
+
+//
+// optional settings for StartServer().
+//
+type Option func(kv *ShardKV)
+
+//
+// authenticate every RPC to the group's servers, and between
+// their Paxos peers, with key (see common.SetKey). every server
+// in the group must be given the same key.
+//
+func WithKey(key []byte) Option {
+	return func(kv *ShardKV) {
+		kv.impl.Key = key
+	}
+}
+
+//
+// answer Get from the Paxos lease holder's state, without
+// agreeing on each one first (see paxos.WithLeases). every
+// server in the group must be given this option.
+//
+func WithLeases() Option {
+	return func(kv *ShardKV) {
+		kv.impl.Leases = true
+	}
+}
+
+//
+// let the group's replicas change (see AddReplica). every server
+// in the group must be given this option.
+//
+func WithReconfig() Option {
+	return func(kv *ShardKV) {
+		kv.impl.Reconfig = true
+	}
+}
+
+//
+// start a replica that joins a running group, e.g. to replace
+// a dead one: servers lists the group's current replicas plus
+// this one. it serves once a replica of the group has called
+// AddReplica for it. implies WithReconfig.
+//
+func WithJoin() Option {
+	return func(kv *ShardKV) {
+		kv.impl.Reconfig = true
+		kv.impl.Join = true
+	}
+}
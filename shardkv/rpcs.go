@@ -4,6 +4,7 @@ const (
 	OK            = "OK"
 	ErrNoKey      = "ErrNoKey"
 	ErrWrongGroup = "ErrWrongGroup"
+	ErrTimeout    = "ErrTimeout" // not agreed on in time; try another server
 )
 
 type Err string
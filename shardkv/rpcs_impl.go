@@ -1,5 +1,9 @@
 package shardkv
 
+import (
+	"umich.edu/eecs491/proj5/common"
+)
+
 // Field names must start with capital letters,
 // otherwise RPC will break.
 
@@ -9,6 +13,7 @@ package shardkv
 type PutAppendArgsImpl struct {
 	RequestId int
 	ConfigNum int
+	Trace     common.TraceContext
 }
 
 //
@@ -17,6 +22,7 @@ type PutAppendArgsImpl struct {
 type GetArgsImpl struct {
 	RequestId int
 	ConfigNum int
+	Trace     common.TraceContext
 }
 
 //
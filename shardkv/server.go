@@ -7,11 +7,10 @@ import (
 	"math/rand"
 	"net"
 	"net/rpc"
-	"os"
 	"sync"
 	"sync/atomic"
-	"syscall"
 
+	"umich.edu/eecs491/proj5/common"
 	"umich.edu/eecs491/proj5/paxos"
 	"umich.edu/eecs491/proj5/paxosrsm"
 )
@@ -68,23 +67,39 @@ func (kv *ShardKV) isunreliable() bool {
 // servers[] contains the ports of the servers
 //   in this replica group.
 // me is the index of this server in servers[].
+// opts are optional settings, e.g. WithKey(key).
 //
-func StartServer(gid int64, servers []string, me int) *ShardKV {
+func StartServer(gid int64, servers []string, me int, opts ...Option) *ShardKV {
 	gob.Register(Op{})
 
 	kv := new(ShardKV)
 	kv.me = me
 	kv.gid = gid
 	kv.InitImpl()
+	kv.impl.Addr = servers[me]
+	for _, opt := range opts {
+		opt(kv)
+	}
 
 	rpcs := rpc.NewServer()
 	rpcs.Register(kv)
 
-	px := paxos.Make(servers, me, rpcs)
-	kv.rsm = paxosrsm.MakeRSM(me, px, kv.ApplyOp, equals)
+	// paxos.WithKey also sets the key for the ShardKV RPCs,
+	// which share the peers' ports.
+	pxopts := []paxos.Option{paxos.WithKey(kv.impl.Key)}
+	if kv.impl.Leases {
+		pxopts = append(pxopts, paxos.WithLeases())
+	}
+	if kv.impl.Reconfig {
+		pxopts = append(pxopts, paxos.WithReconfig())
+	}
+	if kv.impl.Join {
+		pxopts = append(pxopts, paxos.WithJoin())
+	}
+	px := paxos.Make(servers, me, rpcs, pxopts...)
+	kv.rsm = paxosrsm.MakeRSM(me, px, kv.ApplyOp, equals, paxosrsm.WithSnapshots(kv.snapshot, kv.restore))
 
-	os.Remove(servers[me])
-	l, e := net.Listen("unix", servers[me])
+	l, e := common.Listen(servers[me])
 	if e != nil {
 		log.Fatal("listen error: ", e)
 	}
@@ -99,15 +114,17 @@ func StartServer(gid int64, servers []string, me int) *ShardKV {
 					conn.Close()
 				} else if kv.isunreliable() && (rand.Int63()%1000) < 200 {
 					// process the request but force discard of reply.
-					c1 := conn.(*net.UnixConn)
-					f, _ := c1.File()
-					err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
+					err := common.CloseWrite(conn)
 					if err != nil {
 						fmt.Printf("shutdown: %v\n", err)
 					}
-					go rpcs.ServeConn(conn)
+					go common.ServeConn(rpcs, conn, servers[me])
+				} else if kv.isunreliable() {
+					// keep rolling the dice for each request
+					// on this connection.
+					go common.ServeUnreliable(rpcs, conn, kv.isunreliable, servers[me])
 				} else {
-					go rpcs.ServeConn(conn)
+					go common.ServeConn(rpcs, conn, servers[me])
 				}
 			} else if err == nil {
 				conn.Close()
@@ -1,6 +1,9 @@
 package shardkv
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
 	"log"
 	"time"
 
@@ -17,6 +20,7 @@ const (
 	Append = 2
 	Donate = 3
 	Accept = 4
+	Drop   = 5
 )
 
 type Op struct {
@@ -26,9 +30,15 @@ type Op struct {
 	Value     string
 	ConfigNum int
 	Shards    [common.NShards]int64
+	Moved     []int
 	Groups    map[int64][]string
 	Database  map[string]string
 	HandledId map[int]bool
+	Trace     common.TraceContext
+}
+
+func (op Op) TraceContext() common.TraceContext {
+	return op.Trace
 }
 
 //
@@ -48,6 +58,13 @@ type ShardKVImpl struct {
 	Shards    [common.NShards]int64
 	Database  map[string]string
 	HandledId map[int]bool
+	Received  [common.NShards]int // the config each shard's data last arrived for
+	Donated   int                 // the last config whose data every acceptor has
+	Addr      string              // servers[me], to call other servers as
+	Key       []byte              // see WithKey
+	Leases    bool                // see WithLeases
+	Reconfig  bool                // see WithReconfig
+	Join      bool                // see WithJoin
 }
 
 //
@@ -71,20 +88,19 @@ func (kv *ShardKV) Get(args *GetArgs, reply *GetReply) error {
 		reply.Err = ErrWrongGroup
 		return nil
 	}
+	span := common.StartSpan(args.Impl.Trace, kv.impl.Addr, "ShardKV.Get")
+	defer span.End()
+	if kv.rsm.LocalRead(func() {
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
+		kv.read(args.Key, reply)
+	}) {
+		return nil
+	}
 	shard := common.Key2Shard(args.Key)
 	kv.mu.Lock()
 	if _, isHandle := kv.impl.HandledId[args.Impl.RequestId]; isHandle {
-		if kv.impl.Shards[shard] != kv.gid {
-			reply.Err = ErrWrongGroup
-		} else {
-			reply.Err = OK
-			if value, ok := kv.impl.Database[args.Key]; ok {
-				reply.Err = OK
-				reply.Value = value
-			} else {
-				reply.Err = ErrNoKey
-			}
-		}
+		kv.read(args.Key, reply)
 		kv.mu.Unlock()
 		return nil
 	}
@@ -98,22 +114,45 @@ func (kv *ShardKV) Get(args *GetArgs, reply *GetReply) error {
 		RequestId: args.Impl.RequestId,
 		Operation: Get,
 		Key:       args.Key,
+		Trace:     span.Context(),
+	}
+	if err := kv.addOp(op); err != OK {
+		reply.Err = err
+		return nil
 	}
-	kv.rsm.AddOp(op)
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
-	if kv.impl.Shards[shard] != kv.gid {
-		reply.Err = ErrWrongGroup
-		return nil
+	kv.read(args.Key, reply)
+	return nil
+}
+
+//
+// agree on op, giving up after common.OpTimeout: returns OK once
+// op has been applied, and ErrTimeout otherwise. the caller
+// retries under the same RequestId, so op is applied only once.
+//
+func (kv *ShardKV) addOp(op Op) Err {
+	ctx, cancel := context.WithTimeout(context.Background(), common.OpTimeout)
+	defer cancel()
+	if kv.rsm.AddOpContext(ctx, op) != nil {
+		return ErrTimeout
 	}
-	if value, ok := kv.impl.Database[args.Key]; ok {
-		//log.Printf("%v Get on key %v value %v on replica %v of group %v", op.RequestId, op.Key, value, kv.me, kv.gid)
+	return OK
+}
+
+//
+// answer a Get for key from the current state. caller holds kv.mu.
+//
+func (kv *ShardKV) read(key string, reply *GetReply) {
+	if kv.impl.Shards[common.Key2Shard(key)] != kv.gid {
+		reply.Err = ErrWrongGroup
+	} else if value, ok := kv.impl.Database[key]; ok {
+		//log.Printf("Get on key %v value %v on replica %v of group %v", key, value, kv.me, kv.gid)
 		reply.Err = OK
 		reply.Value = value
 	} else {
 		reply.Err = ErrNoKey
 	}
-	return nil
 }
 
 //
@@ -125,6 +164,8 @@ func (kv *ShardKV) PutAppend(args *PutAppendArgs, reply *PutAppendReply) error {
 		return nil
 	}
 	//log.Printf("%v Server %v of group %v received %v rpc with key %v value %v", args.Impl.RequestId, kv.me, kv.gid, args.Op, args.Key, args.Value)
+	span := common.StartSpan(args.Impl.Trace, kv.impl.Addr, "ShardKV.PutAppend")
+	defer span.End()
 	shard := common.Key2Shard(args.Key)
 	kv.mu.Lock()
 	if _, isHandle := kv.impl.HandledId[args.Impl.RequestId]; isHandle {
@@ -143,14 +184,21 @@ func (kv *ShardKV) PutAppend(args *PutAppendArgs, reply *PutAppendReply) error {
 		Operation: Put,
 		Key:       args.Key,
 		Value:     args.Value,
+		Trace:     span.Context(),
 	}
 	if args.Op == "Append" {
 		op.Operation = Append
 	}
-	kv.rsm.AddOp(op)
+	if err := kv.addOp(op); err != OK {
+		reply.Err = err
+		return nil
+	}
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
-	if kv.impl.Shards[shard] != kv.gid {
+	// ApplyOp leaves op unhandled if the shard was not this
+	// group's when op was decided, even if its data has arrived
+	// since.
+	if _, isHandle := kv.impl.HandledId[op.RequestId]; !isHandle {
 		reply.Err = ErrWrongGroup
 		return nil
 	}
@@ -167,6 +215,10 @@ func (kv *ShardKV) ApplyOp(v interface{}) {
 	op := v.(Op)
 	if _, isHandle := kv.impl.HandledId[op.RequestId]; isHandle {
 		return
+	} else if op.Operation <= Append && kv.impl.Shards[common.Key2Shard(op.Key)] != kv.gid {
+		// decided after the shard moved away: leave it unhandled,
+		// so that the client retries it at the new owner.
+		return
 	} else {
 		kv.impl.HandledId[op.RequestId] = true
 		if op.Operation == Put {
@@ -180,44 +232,137 @@ func (kv *ShardKV) ApplyOp(v interface{}) {
 			}
 		} else if op.Operation == Donate {
 			if kv.isNewConfig(op.ConfigNum) {
-				kv.impl.Shards = op.Shards
-				kv.impl.ConfigNum = op.ConfigNum
+				kv.takeShards(op.ConfigNum, op.Shards, nil)
 			}
 		} else if op.Operation == Accept {
 			if kv.isNewConfig(op.ConfigNum) {
-				kv.impl.Shards = op.Shards
-				kv.impl.ConfigNum = op.ConfigNum
+				kv.takeShards(op.ConfigNum, op.Shards, op.Moved)
+				// a shard's data only moves once per config, but
+				// may be handed over more than once; later copies
+				// would undo what was stored since the first.
 				for k, v := range op.Database {
-					kv.impl.Database[k] = v
+					if kv.impl.Received[common.Key2Shard(k)] < op.ConfigNum {
+						kv.impl.Database[k] = v
+					}
+				}
+				for _, shard := range op.Moved {
+					kv.impl.Received[shard] = op.ConfigNum
 				}
 				for k, v := range op.HandledId {
 					kv.impl.HandledId[k] = v
 				}
 			}
+		} else if op.Operation == Drop {
+			// the shards in Moved have been handed over; keep any
+			// that a later config has brought back, even if it has
+			// sent them on again: a Drop from another replica's
+			// retry may come that late.
+			if op.ConfigNum > kv.impl.Donated {
+				kv.impl.Donated = op.ConfigNum
+			}
+			for k := range kv.impl.Database {
+				shard := common.Key2Shard(k)
+				if common.Contains(op.Moved, shard) && kv.impl.Shards[shard] != kv.gid && kv.impl.Received[shard] < op.ConfigNum {
+					delete(kv.impl.Database, k)
+				}
+			}
 		}
 	}
 }
 
-func (kv *ShardKV) sendAcceptRPC(configNum int, shards [common.NShards]int64, database map[string]string, handledId map[int]bool, servers []string) {
+//
+// move to config num, which assigns shards. a shard moving to
+// this group only becomes its own once its data has arrived,
+// in moved or in a later Accept for num; until then the group
+// answers ErrWrongGroup for it, rather than ErrNoKey. caller
+// holds kv.mu.
+//
+func (kv *ShardKV) takeShards(num int, shards [common.NShards]int64, moved []int) {
+	for shard, gid := range shards {
+		if gid != kv.gid || kv.impl.Shards[shard] == kv.gid || common.Contains(moved, shard) {
+			kv.impl.Shards[shard] = gid
+		}
+	}
+	kv.impl.ConfigNum = num
+}
+
+//
+// the state ApplyOp builds up, for PaxosRSM to snapshot.
+//
+type snapshot struct {
+	ConfigNum int
+	Shards    [common.NShards]int64
+	Database  map[string]string
+	HandledId map[int]bool
+	Received  [common.NShards]int
+	Donated   int
+}
+
+func (kv *ShardKV) snapshot() []byte {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(snapshot{
+		ConfigNum: kv.impl.ConfigNum,
+		Shards:    kv.impl.Shards,
+		Database:  kv.impl.Database,
+		HandledId: kv.impl.HandledId,
+		Received:  kv.impl.Received,
+		Donated:   kv.impl.Donated,
+	})
+	if err != nil {
+		log.Fatalf("snapshot: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func (kv *ShardKV) restore(data []byte) {
+	var snap snapshot
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&snap); err != nil {
+		log.Fatalf("restore: %v", err)
+	}
+	if snap.Database == nil {
+		snap.Database = make(map[string]string)
+	}
+	if snap.HandledId == nil {
+		snap.HandledId = make(map[int]bool)
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.impl.ConfigNum = snap.ConfigNum
+	kv.impl.Shards = snap.Shards
+	kv.impl.Database = snap.Database
+	kv.impl.HandledId = snap.HandledId
+	kv.impl.Received = snap.Received
+	kv.impl.Donated = snap.Donated
+}
+
+//
+// hand shards' data to a group. returns false if this server
+// was killed first.
+//
+func (kv *ShardKV) sendAcceptRPC(configNum int, shards [common.NShards]int64, moved []int, database map[string]string, handledId map[int]bool, servers []string) bool {
 	requestId := int(common.Nrand())
 	args := &common.AcceptDataArgs{
 		RequestId: requestId,
 		ConfigNum: configNum,
 		Shards:    shards,
+		Moved:     moved,
 		Database:  database,
 		HandledId: handledId,
 	}
 	var reply common.AcceptDataReply
 	i := 0
 	//log.Printf("3 servers %v", servers)
-	ok := common.Call(servers[i], "ShardKV.AcceptData", args, &reply)
+	ok := common.CallAs(kv.impl.Addr, servers[i], "ShardKV.AcceptData", args, &reply)
 	//log.Printf("4 ok %v reply %v", ok, reply)
-	for !ok {
+	for (!ok || reply.Err != OK) && !kv.isdead() {
 		i += 1
 		i = i % len(servers)
 		time.Sleep(10 * time.Millisecond)
-		ok = common.Call(servers[i], "ShardKV.AcceptData", args, &reply)
+		ok = common.CallAs(kv.impl.Addr, servers[i], "ShardKV.AcceptData", args, &reply)
 	}
+	return ok && reply.Err == OK
 }
 
 //
@@ -238,12 +383,19 @@ func (kv *ShardKV) DonateData(args *common.DonateDataArgs, reply *common.DonateD
 		return nil
 	}
 	kv.mu.Lock()
-	if !kv.isNewConfig(args.ConfigNum) {
-		log.Printf("----------------------Should not get here------------------------")
+	// every shardmaster replica that applies a configuration asks
+	// for its donations, each under its own RequestId, and each
+	// must wait until the data has been handed over before moving
+	// on to the next configuration; the acceptor installs it only
+	// once (see Received). a request for a config this group has
+	// moved to, but whose data may not have arrived yet, hands it
+	// over again.
+	if args.ConfigNum <= kv.impl.Donated {
 		reply.Err = OK
 		kv.mu.Unlock()
 		return nil
 	}
+	isNew := kv.isNewConfig(args.ConfigNum)
 	kv.mu.Unlock()
 	op := Op{
 		RequestId: args.RequestId,
@@ -252,9 +404,20 @@ func (kv *ShardKV) DonateData(args *common.DonateDataArgs, reply *common.DonateD
 		Shards:    args.Shards,
 		Groups:    args.Groups,
 	}
-	kv.rsm.AddOp(op)
+	if isNew {
+		if err := kv.addOp(op); err != OK {
+			reply.Err = common.Err(err)
+			return nil
+		}
+	}
 	kv.mu.Lock()
-	defer kv.mu.Unlock()
+	// hand the data over without holding kv.mu: the acceptor may
+	// be donating to this group at the same time. the data stays
+	// here until every acceptor has it, so that every replica,
+	// and every retry, hands over all of it; it cannot change
+	// once the shards are gone.
+	var sends []func() bool
+	var given []int
 	for group, list := range args.AcceptorDict {
 		database := make(map[string]string)
 		handledId := make(map[int]bool)
@@ -262,15 +425,33 @@ func (kv *ShardKV) DonateData(args *common.DonateDataArgs, reply *common.DonateD
 			shard := common.Key2Shard(k)
 			if common.Contains(list, shard) {
 				database[k] = v
-				delete(kv.impl.Database, k)
 			}
 		}
 		for k, v := range kv.impl.HandledId {
 			handledId[k] = v
 		}
-		kv.sendAcceptRPC(op.ConfigNum, op.Shards, database, handledId, op.Groups[group])
+		servers := op.Groups[group]
+		moved := list
+		given = append(given, list...)
+		sends = append(sends, func() bool {
+			return kv.sendAcceptRPC(op.ConfigNum, op.Shards, moved, database, handledId, servers)
+		})
 	}
-	reply.Err = OK
+	kv.mu.Unlock()
+	for _, send := range sends {
+		if !send() {
+			reply.Err = ErrWrongGroup
+			return nil
+		}
+	}
+	// a retry, after the data is gone, hands over nothing; the
+	// acceptors ignore it (see Received).
+	reply.Err = common.Err(kv.addOp(Op{
+		RequestId: int(common.Nrand()),
+		Operation: Drop,
+		ConfigNum: op.ConfigNum,
+		Moved:     given,
+	}))
 	return nil
 }
 
@@ -293,10 +474,28 @@ func (kv *ShardKV) AcceptData(args *common.AcceptDataArgs, reply *common.AcceptD
 		Operation: Accept,
 		ConfigNum: args.ConfigNum,
 		Shards:    args.Shards,
+		Moved:     args.Moved,
 		Database:  args.Database,
 		HandledId: args.HandledId,
 	}
-	kv.rsm.AddOp(op)
-	reply.Err = OK
+	reply.Err = common.Err(kv.addOp(op))
 	return nil
 }
+
+//
+// agree within the group to add the replica at port, started
+// WithJoin (the group's servers need WithReconfig). returns once
+// the change is decided; the new replica votes paxos.Alpha
+// instances later.
+//
+func (kv *ShardKV) AddReplica(port string) {
+	kv.rsm.AddPeer(port)
+}
+
+//
+// agree within the group to remove the replica at port, e.g.
+// one that has died.
+//
+func (kv *ShardKV) RemoveReplica(port string) {
+	kv.rsm.RemovePeer(port)
+}
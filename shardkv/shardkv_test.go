@@ -1,17 +1,24 @@
 package shardkv
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"net/rpc"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"umich.edu/eecs491/proj5/common"
+	"umich.edu/eecs491/proj5/paxos"
+	"umich.edu/eecs491/proj5/paxosrsm"
 	"umich.edu/eecs491/proj5/shardmaster"
 )
 
@@ -29,6 +36,8 @@ type tCluster struct {
 	mck         *shardmaster.Clerk
 	masterports []string
 	groups      []*tGroup
+	leases      bool     // start the servers WithLeases
+	opts        []Option // and with these
 }
 
 func port(tag string, host int) string {
@@ -46,12 +55,21 @@ func port(tag string, host int) string {
 // start a k/v replica server thread.
 //
 func (tc *tCluster) start1(gi int, si int, unreliable bool) {
-	s := StartServer(tc.groups[gi].gid, tc.groups[gi].ports, si)
+	opts := append([]Option(nil), tc.opts...)
+	if tc.leases {
+		opts = append(opts, WithLeases())
+	}
+	s := StartServer(tc.groups[gi].gid, tc.groups[gi].ports, si, opts...)
 	tc.groups[gi].servers[si] = s
 	s.Setunreliable(unreliable)
 }
 
 func (tc *tCluster) cleanup() {
+	tc.audit()
+	if err := common.FlushTrace(); err != nil {
+		tc.t.Errorf("write trace: %v", err)
+	}
+
 	for gi := 0; gi < len(tc.groups); gi++ {
 		g := tc.groups[gi]
 		for si := 0; si < len(g.servers); si++ {
@@ -68,6 +86,20 @@ func (tc *tCluster) cleanup() {
 	}
 }
 
+//
+// check that no Paxos group decided conflicting values.
+//
+func (tc *tCluster) audit() {
+	for _, problem := range paxos.AuditPorts(tc.masterports) {
+		tc.t.Errorf("shardmaster paxos: %v", problem)
+	}
+	for _, g := range tc.groups {
+		for _, problem := range paxos.AuditPorts(g.ports) {
+			tc.t.Errorf("group %v paxos: %v", g.gid, problem)
+		}
+	}
+}
+
 func (tc *tCluster) shardclerk() *shardmaster.Clerk {
 	return shardmaster.MakeClerk(tc.masterports)
 }
@@ -85,6 +117,10 @@ func (tc *tCluster) leave(gi int) {
 }
 
 func setup(t *testing.T, tag string, unreliable bool) *tCluster {
+	return setupCluster(t, tag, unreliable, false)
+}
+
+func setupCluster(t *testing.T, tag string, unreliable bool, leases bool, opts ...Option) *tCluster {
 	runtime.GOMAXPROCS(4)
 
 	const nmasters = 3
@@ -93,14 +129,20 @@ func setup(t *testing.T, tag string, unreliable bool) *tCluster {
 
 	tc := &tCluster{}
 	tc.t = t
+	tc.leases = leases
+	tc.opts = opts
 	tc.masters = make([]*shardmaster.ShardMaster, nmasters)
 	tc.masterports = make([]string, nmasters)
 
 	for i := 0; i < nmasters; i++ {
 		tc.masterports[i] = port(tag+"m", i)
 	}
+	var mopts []shardmaster.Option
+	if leases {
+		mopts = append(mopts, shardmaster.WithLeases())
+	}
 	for i := 0; i < nmasters; i++ {
-		tc.masters[i] = shardmaster.StartServer(tc.masterports, i)
+		tc.masters[i] = shardmaster.StartServer(tc.masterports, i, mopts...)
 	}
 	tc.mck = tc.shardclerk()
 
@@ -319,7 +361,122 @@ func TestLimp(t *testing.T) {
 	fmt.Printf("  ... Passed\n")
 }
 
-func doConcurrent(t *testing.T, unreliable bool) {
+//
+// route all RPCs through a partition controller for the rest
+// of the test. servers call as their own ports, clerks are
+// anonymous.
+//
+func partitioned() (*common.PartitionController, func()) {
+	pc := common.NewPartitionController(common.DefaultTransport)
+	old := common.SetTransport(pc)
+	return pc, func() { common.SetTransport(old) }
+}
+
+//
+// check that every key has its value, then give it a new one.
+//
+func checkAndUpdate(t *testing.T, ck *Clerk, rr *rand.Rand, keys []string, vals []string, what string) {
+	for i := 0; i < len(keys); i++ {
+		v := ck.Get(keys[i])
+		if v != vals[i] {
+			t.Fatalf("%v; wrong value; k=%v wanted=%v got=%v", what, keys[i], vals[i], v)
+		}
+		vals[i] = strconv.Itoa(rr.Int())
+		ck.Put(keys[i], vals[i])
+	}
+}
+
+func TestJoinMinorityPartition(t *testing.T) {
+	pc, restore := partitioned()
+	defer restore()
+	tc := setup(t, "joinpart", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Join with a partitioned minority ...\n")
+
+	tc.join(0)
+
+	ck := tc.clerk()
+	rr := rand.New(rand.NewSource(int64(os.Getpid())))
+	keys := make([]string, 10)
+	vals := make([]string, len(keys))
+	for i := 0; i < len(keys); i++ {
+		keys[i] = strconv.Itoa(rr.Int())
+		vals[i] = strconv.Itoa(rr.Int())
+		ck.Put(keys[i], vals[i])
+	}
+
+	// cut off one replica of a joining group, and one master,
+	// from everyone else, clerks included.
+	cut := []string{tc.groups[1].ports[2], tc.masterports[2]}
+	id := pc.Isolate(cut, []string{common.AnyEndpoint})
+
+	for g := 1; g < len(tc.groups); g++ {
+		tc.join(g)
+		checkAndUpdate(t, ck, rr, keys, vals, fmt.Sprintf("joining %v", g))
+	}
+
+	// heal, and make the group depend on the replica that was cut off.
+	pc.Remove(id)
+	pc.Isolate([]string{tc.groups[1].ports[0]}, []string{common.AnyEndpoint})
+	checkAndUpdate(t, ck, rr, keys, vals, "after heal")
+	tc.leave(0)
+	checkAndUpdate(t, ck, rr, keys, vals, "leaving 0")
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestLeaveMinorityPartition(t *testing.T) {
+	pc, restore := partitioned()
+	defer restore()
+	tc := setup(t, "leavepart", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Leave with a partitioned minority ...\n")
+
+	for g := 0; g < len(tc.groups); g++ {
+		tc.join(g)
+	}
+
+	ck := tc.clerk()
+	rr := rand.New(rand.NewSource(int64(os.Getpid())))
+	keys := make([]string, 10)
+	vals := make([]string, len(keys))
+	for i := 0; i < len(keys); i++ {
+		keys[i] = strconv.Itoa(rr.Int())
+		vals[i] = strconv.Itoa(rr.Int())
+		ck.Put(keys[i], vals[i])
+	}
+
+	// the first replica of each group, which the masters try
+	// first, and one master can only talk among themselves.
+	var minority []string
+	for g := 0; g < len(tc.groups); g++ {
+		minority = append(minority, tc.groups[g].ports[0])
+	}
+	minority = append(minority, tc.masterports[1])
+	var majority []string
+	for g := 0; g < len(tc.groups); g++ {
+		majority = append(majority, tc.groups[g].ports[1:]...)
+	}
+	majority = append(majority, tc.masterports[0], tc.masterports[2], common.Anonymous)
+	id := pc.Isolate(minority, majority)
+
+	for g := 0; g < len(tc.groups)-1; g++ {
+		tc.leave(g)
+		checkAndUpdate(t, ck, rr, keys, vals, fmt.Sprintf("leaving %v", g))
+	}
+
+	// heal; the replicas that missed the migration must catch up.
+	pc.Remove(id)
+	last := tc.groups[len(tc.groups)-1]
+	pc.Isolate([]string{last.ports[1]}, []string{common.AnyEndpoint})
+	checkAndUpdate(t, ck, rr, keys, vals, "after heal")
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func doConcurrent(t *testing.T, unreliable bool, seed int64) {
 	tc := setup(t, "concurrent-"+strconv.FormatBool(unreliable), unreliable)
 	defer tc.cleanup()
 
@@ -327,15 +484,19 @@ func doConcurrent(t *testing.T, unreliable bool) {
 		tc.join(i)
 	}
 
-	rr := rand.New(rand.NewSource(int64(os.Getpid())))
+	rec := NewRecorder()
 	const npara = 11
+	const nshared = 4 // clients that also use the "shared" key
 	var ca [npara]chan bool
 	for i := 0; i < npara; i++ {
 		ca[i] = make(chan bool)
 		go func(me int) {
 			ok := true
 			defer func() { ca[me] <- ok }()
-			ck := tc.clerk()
+			// a source per client: rand.Rand is not safe to share,
+			// and the seed only replays if no two clients race on it.
+			rr := rand.New(rand.NewSource(seed + int64(me)))
+			ck := rec.Clerk(tc.clerk())
 			mymck := tc.shardclerk()
 			key := strconv.Itoa(me)
 			last := ""
@@ -348,6 +509,13 @@ func doConcurrent(t *testing.T, unreliable bool) {
 					ok = false
 					t.Fatalf("Get(%v) expected %v got %v\n", key, last, v)
 				}
+				// a key a few clients contend on, so that the check
+				// covers more than each client's own order; few
+				// enough to stay well within CheckTimeout.
+				if me < nshared {
+					ck.Append("shared", nv+" ")
+					ck.Get("shared")
+				}
 
 				time.Sleep(time.Duration(rr.Int()%30) * time.Millisecond)
 
@@ -364,17 +532,46 @@ func doConcurrent(t *testing.T, unreliable bool) {
 			t.Fatalf("something is wrong")
 		}
 	}
+
+	if ok, counterExample := rec.Check(); !ok {
+		t.Fatalf("%v", counterExample)
+	}
 }
 
 func TestConcurrent(t *testing.T) {
 	fmt.Printf("Test: Concurrent Put/Get/Move ...\n")
-	doConcurrent(t, false)
+	doConcurrent(t, false, int64(os.Getpid()))
 	fmt.Printf("  ... Passed\n")
 }
 
 func TestConcurrentUnreliable(t *testing.T) {
 	fmt.Printf("Test: Concurrent Put/Get/Move (unreliable) ...\n")
-	doConcurrent(t, true)
+	doConcurrent(t, true, int64(os.Getpid()))
+	fmt.Printf("  ... Passed\n")
+}
+
+//
+// TestConcurrentUnreliable over the simulated network, which
+// drops, delays and reorders messages as its seed dictates.
+// a failure can be replayed with SIM_SEED=<seed>.
+//
+func TestConcurrentSimulated(t *testing.T) {
+	fmt.Printf("Test: Concurrent Put/Get/Move (simulated network) ...\n")
+	sim := common.NewSimNetwork(common.SeedFromEnv())
+	sim.SetDefault(common.LinkConfig{
+		DropRequest: 0.1,
+		DropReply:   0.2,
+		MaxDelay:    2 * time.Millisecond,
+		Reorder:     0.05,
+	})
+	old := common.SetTransport(sim)
+	defer common.SetTransport(old)
+	defer func() {
+		if t.Failed() {
+			t.Logf("replay with SIM_SEED=%v", sim.Seed())
+		}
+	}()
+	doConcurrent(t, false, sim.Seed())
 	fmt.Printf("  ... Passed\n")
 }
 
@@ -388,7 +585,9 @@ func TestLinear(t *testing.T) {
 		tc.join(i)
 	}
 
-	rr := rand.New(rand.NewSource(int64(os.Getpid())))
+	seed := int64(os.Getpid())
+	rr := rand.New(rand.NewSource(seed))
+	rec := NewRecorder()
 	const npara = 100
 	var ca [npara]chan bool
 	for i := 0; i < npara; i++ {
@@ -396,7 +595,9 @@ func TestLinear(t *testing.T) {
 		go func(me int) {
 			ok := true
 			defer func() { ca[me] <- ok }()
-			ck := tc.clerk()
+			// a source per client, as in doConcurrent.
+			rr := rand.New(rand.NewSource(seed + 1 + int64(me)))
+			ck := rec.Clerk(tc.clerk())
 			key := strconv.Itoa(me)
 			last := ""
 			for iters := 0; iters < 3; iters++ {
@@ -446,5 +647,471 @@ func TestLinear(t *testing.T) {
 		}
 	}
 
+	if ok, counterExample := rec.Check(); !ok {
+		t.Fatalf("%v", counterExample)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestTrace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "trace.json")
+	common.TraceTo(path)
+	defer common.TraceTo(os.Getenv("TRACE_FILE"))
+
+	tc := setup(t, "trace", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Tracing a Put through the stack ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+	ck.Put("a", "x")
+	// the learn phase may still be telling the other peers.
+	time.Sleep(100 * time.Millisecond)
+	if err := common.FlushTrace(); err != nil {
+		t.Fatalf("write trace: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var file struct {
+		TraceEvents []struct {
+			Name string
+			Ph   string
+			Args map[string]string
+		}
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatalf("trace is not JSON: %v", err)
+	}
+	spans := make(map[string]map[string]bool) // trace -> span names
+	for _, ev := range file.TraceEvents {
+		if ev.Ph != "X" {
+			continue
+		}
+		if spans[ev.Args["trace"]] == nil {
+			spans[ev.Args["trace"]] = make(map[string]bool)
+		}
+		spans[ev.Args["trace"]][ev.Name] = true
+	}
+	var put map[string]bool
+	for _, names := range spans {
+		if names["Clerk.Put"] {
+			put = names
+		}
+	}
+	if put == nil {
+		t.Fatalf("no trace for the Put")
+	}
+	for _, name := range []string{"ShardKV.PutAppend", "PaxosRSM.AddOp", "Paxos.Proposer",
+		"Paxos.accept", "Paxos.Accept", "Paxos.learn", "Paxos.Learn", "ApplyOp"} {
+		if !put[name] {
+			t.Fatalf("the Put's trace has no %v span; has %v", name, put)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//
+// the lease holder that all of g's servers agree on, "" if they don't.
+//
+func (g *tGroup) leaseHolder() string {
+	holder := ""
+	for i, port := range g.ports {
+		var reply paxos.InspectReply
+		if g.servers[i] == nil || !common.Call(port, "Paxos.Inspect", &paxos.InspectArgs{From: 0, To: -1}, &reply) {
+			continue
+		}
+		if reply.Leased == "" || (holder != "" && reply.Leased != holder) {
+			return ""
+		}
+		holder = reply.Leased
+	}
+	return holder
+}
+
+func TestLeases(t *testing.T) {
+	tc := setupCluster(t, "leases", false, true)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Gets from the lease holder ...\n")
+
+	tc.join(0)
+	g := tc.groups[0]
+	holder := ""
+	for iters := 0; iters < 50 && holder == ""; iters++ {
+		time.Sleep(100 * time.Millisecond)
+		holder = g.leaseHolder()
+	}
+	if holder == "" {
+		t.Fatalf("group %v never settled on a lease holder", g.gid)
+	}
+
+	rec := NewRecorder()
+	const nclients = 5
+	done := make(chan bool)
+	var stop int32
+	for i := 0; i < nclients; i++ {
+		go func(me int) {
+			ok := true
+			defer func() { done <- ok }()
+			ck := rec.Clerk(tc.clerk())
+			key := strconv.Itoa(me)
+			last := ""
+			for n := 0; atomic.LoadInt32(&stop) == 0; n++ {
+				nv := strconv.Itoa(rand.Int())
+				ck.Append(key, nv)
+				last += nv
+				if v := ck.Get(key); v != last {
+					ok = false
+					return
+				}
+				// contend on one key too, for the first few rounds
+				// only, to keep the history checkable.
+				if n < 5 {
+					ck.Append("shared", nv+" ")
+					ck.Get("shared")
+				}
+			}
+		}(i)
+	}
+
+	// kill the holder; another server takes the lease over.
+	time.Sleep(1 * time.Second)
+	for i, port := range g.ports {
+		if port == holder {
+			g.servers[i].kill()
+			g.servers[i] = nil
+		}
+	}
+	time.Sleep(2 * time.Second)
+	if h := g.leaseHolder(); h == "" || h == holder {
+		t.Fatalf("lease did not move from %v, now %v", holder, h)
+	}
+	atomic.StoreInt32(&stop, 1)
+	for i := 0; i < nclients; i++ {
+		if !<-done {
+			t.Fatalf("a Get returned the wrong value")
+		}
+	}
+	if ok, counterExample := rec.Check(); !ok {
+		t.Fatalf("%v", counterExample)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestSnapshotCatchUp(t *testing.T) {
+	pc, restore := partitioned()
+	defer restore()
+	tc := setup(t, "snapshot", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: A lagging replica installs a snapshot ...\n")
+
+	tc.join(0)
+	g := tc.groups[0]
+	ck := tc.clerk()
+
+	// cut one replica off while the others get well past a
+	// snapshot and forget what it covers.
+	id := pc.Isolate([]string{g.ports[0]}, []string{common.AnyEndpoint})
+	rr := rand.New(rand.NewSource(int64(os.Getpid())))
+	keys := make([]string, 10)
+	vals := make([]string, len(keys))
+	for i := 0; i < len(keys); i++ {
+		keys[i] = strconv.Itoa(rr.Int())
+	}
+	for iters := 0; iters < 3*paxosrsm.SnapshotEvery; iters++ {
+		i := iters % len(keys)
+		vals[i] = strconv.Itoa(rr.Int())
+		ck.Put(keys[i], vals[i])
+	}
+	var reply paxos.InspectReply
+	if !common.Call(g.ports[1], "Paxos.Inspect", &paxos.InspectArgs{From: 0, To: -1}, &reply) {
+		t.Fatalf("Inspect failed")
+	}
+	if reply.Forgotten < paxosrsm.SnapshotEvery {
+		t.Fatalf("only forgot through %v with a replica down", reply.Forgotten)
+	}
+
+	// heal, and make the group depend on the replica that lagged.
+	pc.Remove(id)
+	pc.Isolate([]string{g.ports[1]}, []string{common.AnyEndpoint})
+	checkAndUpdate(t, ck, rr, keys, vals, "after heal")
+
+	reply = paxos.InspectReply{}
+	if !common.Call(g.ports[0], "Paxos.Inspect", &paxos.InspectArgs{From: 0, To: -1}, &reply) {
+		t.Fatalf("Inspect failed")
+	}
+	if reply.Snapshot < 0 {
+		t.Fatalf("the lagging replica never installed a snapshot")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestTimeoutWithoutMajority(t *testing.T) {
+	pc, restore := partitioned()
+	defer restore()
+	tc := setup(t, "timeout", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Servers without a majority time out ...\n")
+
+	tc.join(0)
+	g := tc.groups[0]
+	ck := tc.clerk()
+	ck.Put("a", "x")
+
+	// the first replica, and the first master, which the clerks
+	// try first, can still hear from clerks but not from their peers.
+	pc.Isolate([]string{g.ports[0]}, g.ports[1:])
+	pc.Isolate([]string{tc.masterports[0]}, tc.masterports[1:])
+
+	args := &GetArgs{
+		Key: "a",
+		Impl: GetArgsImpl{
+			RequestId: int(common.Nrand()),
+			ConfigNum: tc.mck.Query(-1).Num,
+		},
+	}
+	var reply GetReply
+	start := time.Now()
+	if !common.Call(g.ports[0], "ShardKV.Get", args, &reply) {
+		t.Fatalf("Get to the cut-off replica failed")
+	}
+	if reply.Err != ErrTimeout {
+		t.Fatalf("cut-off replica answered %v, wanted %v", reply.Err, ErrTimeout)
+	}
+	if d := time.Since(start); d > 3*common.OpTimeout {
+		t.Fatalf("cut-off replica took %v to time out", d)
+	}
+
+	// the clerks move on to servers that can make progress.
+	tc.join(1)
+	if v := ck.Get("a"); v != "x" {
+		t.Fatalf("wrong value; wanted x got %v", v)
+	}
+	ck.Put("a", "y")
+	if v := ck.Get("a"); v != "y" {
+		t.Fatalf("wrong value; wanted y got %v", v)
+	}
+	if n := tc.mck.Query(-1).Num; n != 2 {
+		t.Fatalf("wanted config 2 after one retried Join, got %v", n)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestReplaceReplica(t *testing.T) {
+	tc := setupCluster(t, "replace", false, false, WithReconfig())
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Replace a dead replica ...\n")
+
+	tc.join(0)
+	g := tc.groups[0]
+	ck := tc.clerk()
+	for i := 0; i < 10; i++ {
+		ck.Put(strconv.Itoa(i), "x"+strconv.Itoa(i))
+	}
+
+	// the third replica dies; a new one, which numbers the
+	// replicas differently, takes its place.
+	g.servers[2].kill()
+	g.servers[2] = nil
+	newport := port("replace-new", 0)
+	s := StartServer(g.gid, []string{g.ports[0], g.ports[1], newport}, 2, WithJoin())
+	g.servers = append(g.servers, s)
+	g.servers[0].AddReplica(newport)
+	g.servers[0].RemoveReplica(g.ports[2])
+	g.ports = append(g.ports, newport)
+
+	// let the changes take effect.
+	for i := 0; i < 2*paxos.Alpha; i++ {
+		ck.Append("0", "y")
+	}
+
+	// with another original replica dead, the group can only get
+	// anything done with the new one's votes.
+	g.servers[1].kill()
+	g.servers[1] = nil
+	for i := 1; i < 10; i++ {
+		ck.Append(strconv.Itoa(i), "z")
+	}
+
+	// the new replica has the group's data.
+	for i := 0; i < 10; i++ {
+		args := &GetArgs{
+			Key: strconv.Itoa(i),
+			Impl: GetArgsImpl{
+				RequestId: int(common.Nrand()),
+				ConfigNum: tc.mck.Query(-1).Num,
+			},
+		}
+		var reply GetReply
+		if !common.Call(newport, "ShardKV.Get", args, &reply) || reply.Err != OK {
+			t.Fatalf("Get(%v) from the new replica failed: %v", i, reply.Err)
+		}
+		wanted := "x" + strconv.Itoa(i) + "z"
+		if i == 0 {
+			wanted = "x0" + strings.Repeat("y", 2*paxos.Alpha)
+		}
+		if reply.Value != wanted {
+			t.Fatalf("new replica: wrong value for %v; wanted %v got %v", i, wanted, reply.Value)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//
+// the keys s stores for shards that config gives other groups.
+//
+func strayKeys(s *ShardKV, config shardmaster.Config) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var stray []string
+	for k := range s.impl.Database {
+		if config.Shards[common.Key2Shard(k)] != s.gid {
+			stray = append(stray, k)
+		}
+	}
+	return stray
+}
+
+func TestHandOff(t *testing.T) {
+	tc := setup(t, "handoff", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Donors drop data once it has moved ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+	keys := make([]string, 20)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		ck.Put(keys[i], "x"+keys[i])
+	}
+
+	tc.join(1)
+	for i := range keys {
+		if v := ck.Get(keys[i]); v != "x"+keys[i] {
+			t.Fatalf("wrong value for %v after the join; wanted %v got %v", keys[i], "x"+keys[i], v)
+		}
+	}
+
+	// every replica of the donor forgets what it gave away.
+	config := tc.mck.Query(-1)
+	for _, s := range tc.groups[0].servers {
+		var stray []string
+		for iters := 0; iters < 50; iters++ {
+			if stray = strayKeys(s, config); len(stray) == 0 {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if len(stray) > 0 {
+			t.Fatalf("donor %v still has %v", s.me, stray)
+		}
+	}
+
+	// a copy of a moved shard that arrives late does not undo
+	// what was stored since.
+	moved := ""
+	for _, k := range keys {
+		if config.Shards[common.Key2Shard(k)] == tc.groups[1].gid {
+			moved = k
+		}
+	}
+	ck.Put(moved, "y")
+	args := &common.AcceptDataArgs{
+		RequestId: int(common.Nrand()),
+		ConfigNum: config.Num,
+		Shards:    config.Shards,
+		Moved:     []int{common.Key2Shard(moved)},
+		Database:  map[string]string{moved: "x" + moved},
+		HandledId: map[int]bool{},
+	}
+	var reply common.AcceptDataReply
+	if !common.Call(tc.groups[1].ports[0], "ShardKV.AcceptData", args, &reply) || reply.Err != OK {
+		t.Fatalf("AcceptData failed: %v", reply.Err)
+	}
+	if v := ck.Get(moved); v != "y" {
+		t.Fatalf("a late copy overwrote %v; wanted y got %v", moved, v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestAuth(t *testing.T) {
+	key := []byte("group key")
+	tc := setupCluster(t, "auth", false, false, WithKey(key))
+	defer tc.cleanup()
+	defer func() {
+		for _, g := range tc.groups {
+			for _, p := range g.ports {
+				common.SetKey(p, nil)
+			}
+		}
+	}()
+
+	fmt.Printf("Test: Servers started WithKey reject unauthenticated RPCs ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+	ck.Put("a", "x")
+
+	// a server that is not sealed for: the data it would install
+	// and the value it would learn are both refused.
+	srv := tc.groups[0].ports[0]
+	c, err := rpc.Dial(common.Network(srv), srv)
+	if err != nil {
+		t.Fatalf("dial %v: %v", srv, err)
+	}
+	defer c.Close()
+	var shards [common.NShards]int64
+	moved := make([]int, common.NShards)
+	for i := range shards {
+		shards[i] = tc.groups[0].gid
+		moved[i] = i
+	}
+	aargs := &common.AcceptDataArgs{
+		RequestId: int(common.Nrand()),
+		ConfigNum: 1000,
+		Shards:    shards,
+		Moved:     moved,
+		Database:  map[string]string{"a": "forged"},
+		HandledId: map[int]bool{},
+	}
+	var areply common.AcceptDataReply
+	if err := c.Call("ShardKV.AcceptData", aargs, &areply); err == nil {
+		t.Fatalf("an unauthenticated AcceptData went through")
+	}
+	largs := &paxos.DecidedArgs{Seq: 1000, V: Op{RequestId: int(common.Nrand()), Operation: Put, Key: "a", Value: "forged"}}
+	var lreply paxos.DecidedReply
+	if err := c.Call("Paxos.Learn", largs, &lreply); err == nil {
+		t.Fatalf("an unauthenticated Learn went through")
+	}
+
+	// the clerk's sealed requests still work.
+	if v := ck.Get("a"); v != "x" {
+		t.Fatalf("Get(a) got %v, wanted x", v)
+	}
+	ck.Append("a", "y")
+	if v := ck.Get("a"); v != "xy" {
+		t.Fatalf("Get(a) got %v, wanted xy", v)
+	}
+
 	fmt.Printf("  ... Passed\n")
 }
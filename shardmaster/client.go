@@ -28,7 +28,7 @@ func (ck *Clerk) Query(num int) Config {
 		// try each known server
 		for _, srv := range ck.servers {
 			ok := common.Call(srv, "ShardMaster.Query", &args, &reply)
-			if ok {
+			if ok && reply.Err == OK {
 				return reply.Config
 			}
 		}
@@ -37,14 +37,14 @@ func (ck *Clerk) Query(num int) Config {
 }
 
 func (ck *Clerk) Join(gid int64, servers []string) {
-	args := JoinArgs{GID: gid, Servers: servers}
+	args := JoinArgs{GID: gid, Servers: servers, RequestId: int(common.Nrand())}
 	var reply JoinReply
 
 	for {
 		// try each known server
 		for _, srv := range ck.servers {
 			ok := common.Call(srv, "ShardMaster.Join", &args, &reply)
-			if ok {
+			if ok && reply.Err == OK {
 				return
 			}
 		}
@@ -58,14 +58,14 @@ func (ck *Clerk) Join(gid int64, servers []string) {
 }
 
 func (ck *Clerk) Leave(gid int64) {
-	args := LeaveArgs{GID: gid}
+	args := LeaveArgs{GID: gid, RequestId: int(common.Nrand())}
 	var reply LeaveReply
 
 	for {
 		// try each known server
 		for _, srv := range ck.servers {
 			ok := common.Call(srv, "ShardMaster.Leave", &args, &reply)
-			if ok {
+			if ok && reply.Err == OK {
 				return
 			}
 		}
@@ -79,14 +79,14 @@ func (ck *Clerk) Leave(gid int64) {
 }
 
 func (ck *Clerk) Move(shard int, gid int64) {
-	args := MoveArgs{Shard: shard, GID: gid}
+	args := MoveArgs{Shard: shard, GID: gid, RequestId: int(common.Nrand())}
 	var reply MoveReply
 
 	for {
 		// try each known server
 		for _, srv := range ck.servers {
 			ok := common.Call(srv, "ShardMaster.Move", &args, &reply)
-			if ok {
+			if ok && reply.Err == OK {
 				return
 			}
 		}
@@ -0,0 +1,28 @@
+package shardmaster
+
+//
+// optional settings for StartServer().
+//
+type Option func(sm *ShardMaster)
+
+//
+// authenticate every RPC to the shardmasters, and between their
+// Paxos peers, with key (see common.SetKey). every shardmaster
+// must be given the same key.
+//
+func WithKey(key []byte) Option {
+	return func(sm *ShardMaster) {
+		sm.impl.Key = key
+	}
+}
+
+//
+// answer Query from the Paxos lease holder's state, without
+// agreeing on each one first (see paxos.WithLeases). every
+// shardmaster must be given this option.
+//
+func WithLeases() Option {
+	return func(sm *ShardMaster) {
+		sm.impl.Leases = true
+	}
+}
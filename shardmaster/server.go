@@ -7,10 +7,8 @@ import (
 	"math/rand"
 	"net"
 	"net/rpc"
-	"os"
 	"sync"
 	"sync/atomic"
-	"syscall"
 
 	"umich.edu/eecs491/proj5/common"
 	"umich.edu/eecs491/proj5/paxos"
@@ -59,8 +57,9 @@ func (sm *ShardMaster) isunreliable() bool {
 // servers that will cooperate via Paxos to
 // form the fault-tolerant shardmaster service.
 // me is the index of the current server in servers[].
+// opts are optional settings, e.g. WithKey(key).
 //
-func StartServer(servers []string, me int) *ShardMaster {
+func StartServer(servers []string, me int, opts ...Option) *ShardMaster {
 	gob.Register(Op{})
 
 	sm := new(ShardMaster)
@@ -75,13 +74,22 @@ func StartServer(servers []string, me int) *ShardMaster {
 	rpcs := rpc.NewServer()
 	rpcs.Register(sm)
 
-	px := paxos.Make(servers, me, rpcs)
-	sm.rsm = paxosrsm.MakeRSM(me, px, sm.ApplyOp, equals)
-
 	sm.InitImpl()
+	sm.impl.Addr = servers[me]
+	for _, opt := range opts {
+		opt(sm)
+	}
+
+	// paxos.WithKey also sets the key for the shardmaster RPCs,
+	// which share the peers' ports.
+	pxopts := []paxos.Option{paxos.WithKey(sm.impl.Key)}
+	if sm.impl.Leases {
+		pxopts = append(pxopts, paxos.WithLeases())
+	}
+	px := paxos.Make(servers, me, rpcs, pxopts...)
+	sm.rsm = paxosrsm.MakeRSM(me, px, sm.ApplyOp, equals)
 
-	os.Remove(servers[me])
-	l, e := net.Listen("unix", servers[me])
+	l, e := common.Listen(servers[me])
 	if e != nil {
 		log.Fatal("listen error: ", e)
 	}
@@ -96,15 +104,17 @@ func StartServer(servers []string, me int) *ShardMaster {
 					conn.Close()
 				} else if sm.isunreliable() && (rand.Int63()%1000) < 200 {
 					// process the request but force discard of reply.
-					c1 := conn.(*net.UnixConn)
-					f, _ := c1.File()
-					err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
+					err := common.CloseWrite(conn)
 					if err != nil {
 						fmt.Printf("shutdown: %v\n", err)
 					}
-					go rpcs.ServeConn(conn)
+					go common.ServeConn(rpcs, conn, servers[me])
+				} else if sm.isunreliable() {
+					// keep rolling the dice for each request
+					// on this connection.
+					go common.ServeUnreliable(rpcs, conn, sm.isunreliable, servers[me])
 				} else {
-					go rpcs.ServeConn(conn)
+					go common.ServeConn(rpcs, conn, servers[me])
 				}
 			} else if err == nil {
 				conn.Close()
@@ -1,6 +1,7 @@
 package shardmaster
 
 import (
+	"context"
 	"log"
 	"sort"
 	"time"
@@ -41,6 +42,14 @@ func equals(v1 interface{}, v2 interface{}) bool {
 //
 type ShardMasterImpl struct {
 	ShardDistribution map[int64]int // group -> number of assigned shards
+	HandledId         map[int]bool  // the Join, Leave and Move requests applied
+	Handoffs          []func()      // RPCs ApplyOp queued, for handoffLoop to send
+	Queued            int           // hand-offs ever queued
+	Sent              int           // and sent
+	Unreachable       bool          // the one being sent has reached no one for a round
+	Addr              string        // servers[me], to call shardkv servers as
+	Key               []byte        // see WithKey
+	Leases            bool          // see WithLeases
 }
 
 //
@@ -48,6 +57,44 @@ type ShardMasterImpl struct {
 //
 func (sm *ShardMaster) InitImpl() {
 	sm.impl.ShardDistribution = make(map[int64]int)
+	sm.impl.HandledId = make(map[int]bool)
+	go sm.handoffLoop()
+}
+
+//
+// have handoffLoop make send's RPCs once ApplyOp returns: they
+// wait for shardkv groups, which may be waiting for this
+// shardmaster. caller holds sm.mu.
+//
+func (sm *ShardMaster) handoff(send func()) {
+	sm.impl.Handoffs = append(sm.impl.Handoffs, send)
+	sm.impl.Queued += 1
+}
+
+//
+// make the hand-off RPCs one at a time, in the order ApplyOp
+// queued them, so that the groups see each config's hand-offs
+// before the next one's.
+//
+func (sm *ShardMaster) handoffLoop() {
+	for !sm.isdead() {
+		sm.mu.Lock()
+		var send func()
+		if len(sm.impl.Handoffs) > 0 {
+			send = sm.impl.Handoffs[0]
+			sm.impl.Handoffs = sm.impl.Handoffs[1:]
+		}
+		sm.mu.Unlock()
+		if send == nil {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		send()
+		sm.mu.Lock()
+		sm.impl.Sent += 1
+		sm.impl.Unreachable = false
+		sm.mu.Unlock()
+	}
 }
 
 func (sm *ShardMaster) getLatestConfig() Config {
@@ -64,9 +111,10 @@ func (sm *ShardMaster) getLatestConfig() Config {
 // RPC handlers for Join, Leave, Move, and Query RPCs
 //
 func (sm *ShardMaster) Join(args *JoinArgs, reply *JoinReply) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-	requestId := int(common.Nrand())
+	requestId := args.RequestId
+	if requestId == 0 {
+		requestId = int(common.Nrand())
+	}
 	op := Op{
 		RequestId: requestId,
 		Operation: Join,
@@ -75,14 +123,15 @@ func (sm *ShardMaster) Join(args *JoinArgs, reply *JoinReply) error {
 		Shard:     0,
 		ConfigNum: 0,
 	}
-	sm.rsm.AddOp(op)
+	reply.Err = sm.change(op)
 	return nil
 }
 
 func (sm *ShardMaster) Leave(args *LeaveArgs, reply *LeaveReply) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-	requestId := int(common.Nrand())
+	requestId := args.RequestId
+	if requestId == 0 {
+		requestId = int(common.Nrand())
+	}
 	op := Op{
 		RequestId: requestId,
 		Operation: Leave,
@@ -91,14 +140,15 @@ func (sm *ShardMaster) Leave(args *LeaveArgs, reply *LeaveReply) error {
 		Shard:     0,
 		ConfigNum: 0,
 	}
-	sm.rsm.AddOp(op)
+	reply.Err = sm.change(op)
 	return nil
 }
 
 func (sm *ShardMaster) Move(args *MoveArgs, reply *MoveReply) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-	requestId := int(common.Nrand())
+	requestId := args.RequestId
+	if requestId == 0 {
+		requestId = int(common.Nrand())
+	}
 	op := Op{
 		RequestId: requestId,
 		Operation: Move,
@@ -107,13 +157,18 @@ func (sm *ShardMaster) Move(args *MoveArgs, reply *MoveReply) error {
 		Shard:     args.Shard,
 		ConfigNum: 0,
 	}
-	sm.rsm.AddOp(op)
+	reply.Err = sm.change(op)
 	return nil
 }
 
 func (sm *ShardMaster) Query(args *QueryArgs, reply *QueryReply) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	if sm.rsm.LocalRead(func() {
+		sm.mu.Lock()
+		defer sm.mu.Unlock()
+		sm.query(args, reply)
+	}) {
+		return nil
+	}
 	requestId := int(common.Nrand())
 	op := Op{
 		RequestId: requestId,
@@ -123,14 +178,67 @@ func (sm *ShardMaster) Query(args *QueryArgs, reply *QueryReply) error {
 		Shard:     0,
 		ConfigNum: args.Num,
 	}
-	sm.rsm.AddOp(op)
+	if err := sm.addOp(op); err != OK {
+		reply.Err = err
+		return nil
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.query(args, reply)
+	return nil
+}
+
+//
+// agree on op, giving up after common.OpTimeout: returns OK once
+// op has been applied, and ErrTimeout otherwise. a Join, Leave
+// or Move that timed out may still be applied later; a retry
+// under the same RequestId is then ignored.
+//
+func (sm *ShardMaster) addOp(op Op) Err {
+	ctx, cancel := context.WithTimeout(context.Background(), common.OpTimeout)
+	defer cancel()
+	if sm.rsm.AddOpContext(ctx, op) != nil {
+		return ErrTimeout
+	}
+	return OK
+}
+
+//
+// addOp() for a Join, Leave or Move, which then also waits, up
+// to common.OpTimeout, until the shardkv groups have been sent
+// the data the new config moves: a group that has left may be
+// shut down as soon as the Leave returns. it does not wait for
+// a group none of whose servers answer; that hand-off goes on
+// in the background.
+//
+func (sm *ShardMaster) change(op Op) Err {
+	if err := sm.addOp(op); err != OK {
+		return err
+	}
+	sm.mu.Lock()
+	queued := sm.impl.Queued
+	sm.mu.Unlock()
+	start := time.Now()
+	for !sm.isdead() && time.Since(start) < common.OpTimeout {
+		sm.mu.Lock()
+		done := sm.impl.Sent >= queued || sm.impl.Unreachable
+		sm.mu.Unlock()
+		if done {
+			return OK
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return ErrTimeout
+}
+
+func (sm *ShardMaster) query(args *QueryArgs, reply *QueryReply) {
+	reply.Err = OK
 	config := sm.getLatestConfig()
 	if args.Num == -1 || args.Num > config.Num {
 		reply.Config = config
 	} else {
 		reply.Config = sm.configs[args.Num]
 	}
-	return nil
 }
 
 func (sm *ShardMaster) sortMapKey(m map[int64]int) []int64 {
@@ -316,10 +424,13 @@ func (sm *ShardMaster) leaveReassign(shards [common.NShards]int64, leaver int64)
 //
 
 func (sm *ShardMaster) ApplyOp(v interface{}) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
 	op := v.(Op)
-	if op.Operation == Query {
+	if op.Operation == Query || sm.impl.HandledId[op.RequestId] {
 		return
 	}
+	sm.impl.HandledId[op.RequestId] = true
 	lastConfig := sm.getLatestConfig()
 	if op.Operation == Join {
 		groups := make(map[int64][]string)
@@ -352,12 +463,16 @@ func (sm *ShardMaster) ApplyOp(v interface{}) {
 		if len(donors) == 0 && config.Num == 1 {
 			database := make(map[string]string)
 			handledId := make(map[int]bool)
-			sm.sendAcceptRPC(config.Num, shards, database, handledId, sendGroups[shards[0]])
-		} else if len(donors) > 0 {
-			for i := range donors {
-				acceptorDict := sm.findAcceptors(lastConfig, config, donors[i])
-				sm.sendDonateRPC(config.Num, config.Shards, sendGroups, acceptorDict, sendGroups[donors[i]])
+			moved := make([]int, common.NShards)
+			for i := range moved {
+				moved[i] = i
 			}
+			servers := sendGroups[shards[0]]
+			sm.handoff(func() {
+				sm.sendAcceptRPC(config.Num, shards, moved, database, handledId, servers)
+			})
+		} else if len(donors) > 0 {
+			sm.handoffDonations(lastConfig, config, sendGroups, donors)
 		}
 	} else if op.Operation == Leave {
 		groups := make(map[int64][]string)
@@ -381,10 +496,7 @@ func (sm *ShardMaster) ApplyOp(v interface{}) {
 		for k, v := range lastConfig.Groups {
 			sendGroups[k] = v
 		}
-		for i := range donors {
-			acceptorDict := sm.findAcceptors(lastConfig, config, donors[i])
-			sm.sendDonateRPC(config.Num, config.Shards, sendGroups, acceptorDict, sendGroups[donors[i]])
-		}
+		sm.handoffDonations(lastConfig, config, sendGroups, donors)
 	} else {
 		if _, ok := lastConfig.Groups[op.GID]; !ok {
 			log.Printf("Move to unknown group!")
@@ -411,13 +523,35 @@ func (sm *ShardMaster) ApplyOp(v interface{}) {
 		for k, v := range config.Groups {
 			sendGroups[k] = v
 		}
-		for i := range donors {
-			acceptorDict := sm.findAcceptors(lastConfig, config, donors[i])
-			sm.sendDonateRPC(config.Num, config.Shards, sendGroups, acceptorDict, sendGroups[donors[i]])
-		}
+		sm.handoffDonations(lastConfig, config, sendGroups, donors)
 	}
 }
 
+//
+// queue a DonateData for each donor from lastConfig to config.
+// caller holds sm.mu.
+//
+func (sm *ShardMaster) handoffDonations(lastConfig Config, config Config, groups map[int64][]string, donors []int64) {
+	for _, donor := range donors {
+		acceptorDict := sm.findAcceptors(lastConfig, config, donor)
+		servers := groups[donor]
+		sm.handoff(func() {
+			sm.sendDonateRPC(config.Num, config.Shards, groups, acceptorDict, servers)
+		})
+	}
+}
+
+//
+// the hand-off being sent has failed to reach any server for
+// fails calls in a row; after a round of servers, change()
+// stops waiting for it.
+//
+func (sm *ShardMaster) noteFailures(fails int, servers []string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.impl.Unreachable = fails >= len(servers)
+}
+
 func (sm *ShardMaster) sendDonateRPC(configNum int, shards [common.NShards]int64, groups map[int64][]string, acceptorDict map[int64][]int, servers []string) {
 	requestId := int(common.Nrand())
 	args := &common.DonateDataArgs{
@@ -429,31 +563,46 @@ func (sm *ShardMaster) sendDonateRPC(configNum int, shards [common.NShards]int64
 	}
 	var reply common.DonateDataReply
 	i := 0
-	ok := common.Call(servers[i], "ShardKV.DonateData", args, &reply)
-	for !ok {
+	fails := 0
+	ok := common.CallAs(sm.impl.Addr, servers[i], "ShardKV.DonateData", args, &reply)
+	for (!ok || reply.Err != common.OK) && !sm.isdead() {
+		if ok {
+			fails = 0
+		} else {
+			fails += 1
+		}
+		sm.noteFailures(fails, servers)
 		i += 1
 		i = i % len(servers)
 		time.Sleep(10 * time.Millisecond)
-		ok = common.Call(servers[i], "ShardKV.DonateData", args, &reply)
+		ok = common.CallAs(sm.impl.Addr, servers[i], "ShardKV.DonateData", args, &reply)
 	}
 	//log.Printf("%v Sent donateRPC to server %v with confignum %v, shards %v, acceptordict %v", requestId, servers[i], configNum, shards, acceptorDict)
 }
 
-func (sm *ShardMaster) sendAcceptRPC(configNum int, shards [common.NShards]int64, database map[string]string, handledId map[int]bool, servers []string) {
+func (sm *ShardMaster) sendAcceptRPC(configNum int, shards [common.NShards]int64, moved []int, database map[string]string, handledId map[int]bool, servers []string) {
 	for i := 0; i < len(servers); i++ {
 		requestId := int(common.Nrand())
 		args := &common.AcceptDataArgs{
 			RequestId: requestId,
 			ConfigNum: configNum,
 			Shards:    shards,
+			Moved:     moved,
 			Database:  database,
 			HandledId: handledId,
 		}
 		var reply common.AcceptDataReply
-		ok := common.Call(servers[i], "ShardKV.AcceptData", args, &reply)
-		for !ok {
+		fails := 0
+		ok := common.CallAs(sm.impl.Addr, servers[i], "ShardKV.AcceptData", args, &reply)
+		for (!ok || reply.Err != common.OK) && !sm.isdead() {
+			if ok {
+				fails = 0
+			} else {
+				fails += 1
+			}
+			sm.noteFailures(fails, servers)
 			time.Sleep(10 * time.Millisecond)
-			ok = common.Call(servers[i], "ShardKV.AcceptData", args, &reply)
+			ok = common.CallAs(sm.impl.Addr, servers[i], "ShardKV.AcceptData", args, &reply)
 		}
 	}
 }
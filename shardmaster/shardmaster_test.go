@@ -9,6 +9,7 @@ import (
 	"testing"
 
 	"umich.edu/eecs491/proj5/common"
+	"umich.edu/eecs491/proj5/paxos"
 )
 
 func port(tag string, host int) string {
@@ -30,6 +31,15 @@ func cleanup(sma []*ShardMaster) {
 	}
 }
 
+//
+// check that the shardmasters' Paxos peers agree.
+//
+func audit(t *testing.T, ports []string) {
+	for _, problem := range paxos.AuditPorts(ports) {
+		t.Errorf("paxos: %v", problem)
+	}
+}
+
 func check(t *testing.T, groups []int64, ck *Clerk) {
 	c := ck.Query(-1)
 	if len(c.Groups) != len(groups) {
@@ -85,6 +95,7 @@ func TestBasic(t *testing.T) {
 	for i := 0; i < nservers; i++ {
 		kvh[i] = port("basic", i)
 	}
+	defer audit(t, kvh)
 	for i := 0; i < nservers; i++ {
 		sma[i] = StartServer(kvh, i)
 	}
@@ -290,6 +301,7 @@ func TestUnreliable(t *testing.T) {
 	for i := 0; i < nservers; i++ {
 		kvh[i] = port("unrel", i)
 	}
+	defer audit(t, kvh)
 	for i := 0; i < nservers; i++ {
 		sma[i] = StartServer(kvh, i)
 		// don't turn on unreliable because the project
@@ -21,6 +21,13 @@ import (
 // A GID is a replica group ID. GIDs must be unique and > 0.
 //
 
+const (
+	OK         = "OK"
+	ErrTimeout = "ErrTimeout" // not agreed on in time; try another server
+)
+
+type Err string
+
 type Config struct {
 	Num    int                // config number
 	Shards [common.NShards]int64     // shard -> gid
@@ -28,26 +35,32 @@ type Config struct {
 }
 
 type JoinArgs struct {
-	GID     int64    // unique replica group ID
-	Servers []string // group server ports
+	GID       int64    // unique replica group ID
+	Servers   []string // group server ports
+	RequestId int      // picked by the clerk; retries reuse it
 }
 
 type JoinReply struct {
+	Err Err
 }
 
 type LeaveArgs struct {
-	GID int64
+	GID       int64
+	RequestId int
 }
 
 type LeaveReply struct {
+	Err Err
 }
 
 type MoveArgs struct {
-	Shard int
-	GID   int64
+	Shard     int
+	GID       int64
+	RequestId int
 }
 
 type MoveReply struct {
+	Err Err
 }
 
 type QueryArgs struct {
@@ -55,5 +68,6 @@ type QueryArgs struct {
 }
 
 type QueryReply struct {
+	Err    Err
 	Config Config
 }